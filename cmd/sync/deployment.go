@@ -0,0 +1,52 @@
+package sync
+
+import (
+	"context"
+	"log"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/google/go-github/v33/github"
+	"github.com/pkg/errors"
+)
+
+// deploy registers a GitHub Deployment of commit to the deployment environment, in progress until the outcome is reported
+func (state State) deploy(commit *object.Commit) (*github.Deployment, error) {
+	Global := state.Global
+	ctx := context.Background()
+	log.Printf("Creating deployment of %s to %s", commit.Hash, Global.DeploymentEnvironment)
+	owner, repo := state.deploymentRepo()
+	deployment, _, err := state.client.Repositories.CreateDeployment(ctx, owner, repo, &github.DeploymentRequest{
+		Ref:         refStr(commit.Hash.String()),
+		Environment: &Global.DeploymentEnvironment,
+		// The commit is already pushed: do not merge the default branch into it, nor wait for its checks
+		AutoMerge:        refBool(false),
+		RequiredContexts: &[]string{},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "creating deployment")
+	}
+	return deployment, state.deploymentStatus(ctx, deployment, "in_progress")
+}
+
+// deploymentRepo is where deployments are registered: for forks the PR repository, which has the environments
+// and the merge commit of -wait-for-pr-merge
+func (state State) deploymentRepo() (owner, repo string) {
+	if state.isFork() {
+		return state.prOrgName, state.prRepoName
+	}
+	return state.orgName, state.repoName
+}
+
+// deploymentStatus sets the state of deployment, linking to the pipeline
+func (state State) deploymentStatus(ctx context.Context, deployment *github.Deployment, status string) error {
+	request := &github.DeploymentStatusRequest{
+		State:       &status,
+		Environment: refStr(deployment.GetEnvironment()),
+	}
+	if state.Global.PipelineURL != "" {
+		request.LogURL = &state.Global.PipelineURL
+	}
+	owner, repo := state.deploymentRepo()
+	_, _, err := state.client.Repositories.CreateDeploymentStatus(ctx, owner, repo, deployment.GetID(), request)
+	return errors.Wrapf(err, "setting deployment status %s", status)
+}
@@ -0,0 +1,125 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/Q42Philips/gitops-sync/pkg/forge"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/google/go-github/v33/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeploy(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	state.Global.DeploymentEnvironment = "production"
+	state.Global.PipelineURL = "https://ci.example.com/jobs/1"
+	mux := state.githubStub(t)
+	var deployments, statuses []map[string]interface{}
+	recordJSON(mux, "/repos/Q42Philips/gitops/deployments", &deployments, `{"id": 12, "environment": "production"}`)
+	recordJSON(mux, "/repos/Q42Philips/gitops/deployments/12/statuses", &statuses, `{}`)
+
+	hash := plumbing.NewHash("0123456789abcdef0123456789abcdef01234567")
+	deployment, err := state.deploy(&object.Commit{Hash: hash})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(12), deployment.GetID())
+	if assert.Len(t, deployments, 1) {
+		assert.Equal(t, hash.String(), deployments[0]["ref"])
+		assert.Equal(t, "production", deployments[0]["environment"])
+		assert.Equal(t, []interface{}{}, deployments[0]["required_contexts"])
+	}
+
+	err = state.report(context.Background(), Result{Deployment: deployment}, errors.New("timeout"))
+	assert.NoError(t, err)
+	if assert.Len(t, statuses, 2) {
+		assert.Equal(t, "in_progress", statuses[0]["state"])
+		assert.Equal(t, "https://ci.example.com/jobs/1", statuses[0]["log_url"])
+		assert.Equal(t, "failure", statuses[1]["state"])
+	}
+}
+
+// TestDeployFork registers the deployment in the PR repository of a fork
+func TestDeployFork(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	state.prOrgName = "Upstream"
+	state.Global.DeploymentEnvironment = "production"
+	mux := state.githubStub(t)
+	var deployments, statuses []map[string]interface{}
+	recordJSON(mux, "/repos/Upstream/gitops/deployments", &deployments, `{"id": 12, "environment": "production"}`)
+	recordJSON(mux, "/repos/Upstream/gitops/deployments/12/statuses", &statuses, `{}`)
+
+	deployment, err := state.deploy(&object.Commit{Hash: plumbing.NewHash("0123456789abcdef0123456789abcdef01234567")})
+	assert.NoError(t, err)
+	err = state.report(context.Background(), Result{Deployment: deployment}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, deployments, 1)
+	assert.Len(t, statuses, 2)
+}
+
+func TestSourceStatus(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	state.Global.SourceRepo = "https://github.com/Q42Philips/app"
+	state.Global.SourceCommit = "abc123"
+	state.Global.SourceStatus = "gitops/production"
+	mux := state.githubStub(t)
+	var statuses []map[string]interface{}
+	recordJSON(mux, "/repos/Q42Philips/app/statuses/abc123", &statuses, `{"state": "pending", "context": "gitops/production", "target_url": "https://github.com/Q42Philips/gitops/pull/7"}`)
+
+	hash := plumbing.NewHash("0123456789abcdef0123456789abcdef01234567")
+	result := Result{Commit: &object.Commit{Hash: hash}, PR: &forge.PullRequest{URL: "https://github.com/Q42Philips/gitops/pull/7"}}
+	var err error
+	result.SourceStatus, err = state.sourceStatus(result)
+	assert.NoError(t, err)
+	err = state.report(context.Background(), result, nil)
+	assert.NoError(t, err)
+	if assert.Len(t, statuses, 2) {
+		assert.Equal(t, "pending", statuses[0]["state"])
+		assert.Equal(t, "https://github.com/Q42Philips/gitops/pull/7", statuses[0]["target_url"])
+		assert.Equal(t, "Synced to Q42Philips/gitops@0123456", statuses[0]["description"])
+		assert.Equal(t, "success", statuses[1]["state"])
+		assert.Equal(t, "gitops/production", statuses[1]["context"])
+		assert.Equal(t, "https://github.com/Q42Philips/gitops/pull/7", statuses[1]["target_url"])
+	}
+}
+
+func TestReportBoth(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	state.Global.SourceRepo = "https://github.com/Q42Philips/app"
+	state.Global.SourceCommit = "abc123"
+	mux := state.githubStub(t)
+	mux.HandleFunc("/repos/Q42Philips/gitops/deployments/12/statuses", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "unavailable"}`, http.StatusServiceUnavailable)
+	})
+	var statuses []map[string]interface{}
+	recordJSON(mux, "/repos/Q42Philips/app/statuses/abc123", &statuses, `{}`)
+
+	// A failing deployment status still reports the outcome on the source commit
+	result := Result{
+		Deployment:   &github.Deployment{ID: github.Int64(12), Environment: github.String("production")},
+		SourceStatus: &github.RepoStatus{Context: github.String("gitops/production")},
+	}
+	err := state.report(context.Background(), result, errors.New(strings.Repeat("é", 200)))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "setting deployment status failure")
+	}
+	if assert.Len(t, statuses, 1) {
+		assert.Equal(t, "failure", statuses[0]["state"])
+		description := statuses[0]["description"].(string)
+		assert.True(t, utf8.ValidString(description))
+		assert.Equal(t, 140, utf8.RuneCountInString(description))
+	}
+}
@@ -0,0 +1,188 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	. "github.com/Q42Philips/gitops-sync/pkg/config"
+	"github.com/Q42Philips/gitops-sync/pkg/forge"
+	"github.com/Q42Philips/gitops-sync/pkg/gitlogic"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/google/go-github/v33/github"
+	"github.com/pkg/errors"
+)
+
+// GC deletes the stale head branches: those matching -gc-branches which are merged (or squashed) into the base,
+// older than -gc-max-age and have no open pull request.
+func GC(Global Config) (deleted []string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			var isErr bool
+			if err, isErr = r.(error); !isErr {
+				err = fmt.Errorf("%s", fmt.Sprint(r))
+			}
+		}
+	}()
+
+	state := State{}
+	if err = state.fromConfig(Global); err != nil {
+		return nil, errors.Wrap(err, "prepare")
+	}
+	return state.gc(time.Now())
+}
+
+func (state State) gc(now time.Time) (deleted []string, err error) {
+	Global := state.Global
+	baseRefName := plumbing.NewBranchReferenceName(FirstStr(Global.BaseMerge, Global.BasePR, Global.OutputBase))
+	baseRef, err := state.outputRepo.Reference(baseRefName, true)
+	orPanic(errors.WithStack(err), fmt.Sprintf("base branch %q does not exist, check your inputs", baseRefName.Short()))
+	baseCommit, err := state.outputRepo.CommitObject(baseRef.Hash())
+	orPanic(errors.WithStack(err), "base commit")
+	squashes, err := syncCommits(baseCommit)
+	orPanic(errors.WithStack(err), "listing sync commits of the base")
+
+	log.Printf("Collecting branches matching %q merged into %s and older than %s", Global.GCBranches.String(), baseRefName.Short(), Global.GCMaxAge)
+	branches, err := state.outputRepo.Branches()
+	orPanic(errors.WithStack(err), "listing branches")
+	var updates []gitlogic.RefUpdate
+	err = branches.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().Short()
+		if ref.Name() == baseRefName || !Global.GCBranches.Match(name) {
+			return nil
+		}
+		commit, err := state.outputRepo.CommitObject(ref.Hash())
+		if err != nil {
+			return errors.Wrapf(err, "commit of %s", name)
+		}
+		if age := now.Sub(commit.Committer.When); age < Global.GCMaxAge {
+			log.Printf("- keeping %s: last commit is only %s old", name, age.Round(time.Minute))
+			return nil
+		}
+		merged, err := commit.IsAncestor(baseCommit)
+		if err == nil && !merged {
+			merged, err = squashMerged(commit, squashes)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "checking if %s is merged", name)
+		} else if !merged {
+			log.Printf("- keeping %s: not merged into %s", name, baseRefName.Short())
+			return nil
+		}
+		if pr := state.openPR(name); pr != nil {
+			log.Printf("- keeping %s: pull request %s is open", name, pr.URL)
+			return nil
+		}
+		log.Printf("- deleting %s", name)
+		deleted = append(deleted, name)
+		updates = append(updates, gitlogic.RefUpdate{Name: ref.Name(), Old: ref.Hash(), New: plumbing.ZeroHash})
+		return nil
+	})
+	orPanic(err, "collecting branches")
+
+	if len(updates) == 0 {
+		log.Println("Nothing to delete")
+		return deleted, nil
+	}
+	if Global.DryRun {
+		log.Println("Stopping now because of dry-run")
+		return deleted, nil
+	}
+	err = state.push(updates)
+	orPanic(errors.WithStack(err), "deleting branches")
+	return deleted, nil
+}
+
+// syncCommits indexes the commits of base that have provenance trailers by these trailers
+func syncCommits(base *object.Commit) (map[string][]*object.Commit, error) {
+	commits := make(map[string][]*object.Commit)
+	err := object.NewCommitPreorderIter(base, nil, nil).ForEach(func(c *object.Commit) error {
+		if trailers := gitlogic.ParseTrailers(c.Message); trailers.Get(gitlogic.TrailerSyncedBy) != "" {
+			commits[trailers.String()] = append(commits[trailers.String()], c)
+		}
+		return nil
+	})
+	return commits, err
+}
+
+// squashMerged checks whether head was merged with -merge-mode squash (or ff, when it had to squash): the base has a
+// commit with the same provenance trailers which contains all changes of head
+func squashMerged(head *object.Commit, squashes map[string][]*object.Commit) (bool, error) {
+	trailers := gitlogic.ParseTrailers(head.Message)
+	if trailers.Get(gitlogic.TrailerSyncedBy) == "" || head.NumParents() != 1 {
+		return false, nil
+	}
+	parent, err := head.Parent(0)
+	if err != nil {
+		return false, err
+	}
+	changes, err := commitChanges(parent, head)
+	if err != nil {
+		return false, err
+	}
+	for _, squash := range squashes[trailers.String()] {
+		if contained, err := containsChanges(squash, changes); err != nil || contained {
+			return contained, err
+		}
+	}
+	return false, nil
+}
+
+func commitChanges(from, to *object.Commit) (object.Changes, error) {
+	fromTree, err := from.Tree()
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := to.Tree()
+	if err != nil {
+		return nil, err
+	}
+	return object.DiffTree(fromTree, toTree)
+}
+
+// containsChanges checks whether the files of commit match the result of the changes
+func containsChanges(commit *object.Commit, changes object.Changes) (bool, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return false, err
+	}
+	for _, change := range changes {
+		_, to, err := change.Files()
+		if err != nil {
+			return false, err
+		}
+		if to == nil {
+			if _, err = tree.File(change.From.Name); err != object.ErrFileNotFound {
+				return false, nil
+			}
+			continue
+		}
+		if f, err := tree.File(to.Name); err != nil || f.Hash != to.Hash {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// openPR returns an open pull request from branch, if any
+func (state State) openPR(branch string) *forge.PullRequest {
+	if state.forge != nil {
+		pr, err := state.forge.FindPullRequest(context.Background(), branch, "")
+		orPanic(errors.WithStack(err), "getting open prs")
+		return pr
+	}
+	if state.client == nil {
+		return nil
+	}
+	prs, _, err := state.client.PullRequests.List(context.Background(), state.prOrgName, state.prRepoName, &github.PullRequestListOptions{
+		Head:  fmt.Sprintf("%s:%s", state.orgName, branch),
+		State: "open",
+	})
+	orPanic(errors.WithStack(err), "getting open prs")
+	if len(prs) > 0 {
+		return githubPullRequest(prs[0])
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package sync
+
+import (
+	"log"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/Q42Philips/gitops-sync/pkg/config"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGC(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	orPanic(state.Global.GCBranches.Set("auto/sync/*"), "glob")
+	state.Global.GCMaxAge = time.Hour
+
+	external, externalURL := prepareExternal()
+	production, err := external.Reference(plumbing.NewBranchReferenceName("production"), true)
+	orPanic(errors.WithStack(err), "production")
+	orPanic(external.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("auto/sync/merged"), production.Hash())), "branch")
+	orPanic(external.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("auto/sync/unmerged"), production.Hash())), "branch")
+	commitExternal(external, "auto/sync/unmerged", "bases/microservice-a/template.yaml", "unmerged: true")
+
+	// A sync squashed into production, and one of the same source that is not
+	for _, head := range []string{"auto/sync/squashed", "auto/sync/other"} {
+		s := state.withFreshInput().withFreshOutput(externalURL)
+		s.Global.OutputHead = head
+		if head == "auto/sync/squashed" {
+			s.Global.BaseMerge = "production"
+			s.Global.MergeMode = config.MergeModeSquash
+		} else {
+			s.Global.InputPath = t.TempDir()
+			s.inputFs = osfs.New(s.Global.InputPath)
+			orPanic(os.WriteFile(path.Join(s.Global.InputPath, "template.yaml"), []byte(`template: 2`), 0644), "write dummy file")
+		}
+		_, _, err := s.syncAndMerge()
+		assert.NoError(t, err)
+	}
+
+	// Dry-run only reports
+	s := state.withFreshOutput(externalURL)
+	s.Global.DryRun = true
+	deleted, err := s.gc(time.Now())
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"auto/sync/merged", "auto/sync/squashed"}, deleted)
+	_, err = external.Reference(plumbing.NewBranchReferenceName("auto/sync/merged"), true)
+	assert.NoError(t, err)
+
+	// Nothing is old enough
+	s.Global.DryRun = false
+	deleted, err = s.gc(time.Time{}.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Empty(t, deleted)
+
+	// Delete
+	deleted, err = s.gc(time.Now())
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"auto/sync/merged", "auto/sync/squashed"}, deleted)
+	_, err = external.Reference(plumbing.NewBranchReferenceName("auto/sync/merged"), true)
+	assert.Equal(t, plumbing.ErrReferenceNotFound, err)
+	for _, kept := range []string{"auto/sync/unmerged", "auto/sync/other"} {
+		_, err = external.Reference(plumbing.NewBranchReferenceName(kept), true)
+		assert.NoError(t, err, kept)
+	}
+}
@@ -6,9 +6,11 @@ import (
 	"log"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	. "github.com/Q42Philips/gitops-sync/pkg/config"
+	"github.com/Q42Philips/gitops-sync/pkg/forge"
 	"github.com/Q42Philips/gitops-sync/pkg/githubutil"
 	"github.com/Q42Philips/gitops-sync/pkg/gitlogic"
 	"github.com/go-git/go-billy/v5"
@@ -18,27 +20,44 @@ import (
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/go-git/go-git/v5/storage/memory"
 	"github.com/google/go-github/v33/github"
 	"github.com/koron-go/prefixw"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
 )
 
 type Result struct {
-	Commit     *object.Commit
+	Commit *object.Commit
+	// Previous commit of the head branch, zero if the head branch is new
+	Previous   plumbing.Hash
 	Repository *git.Repository
-	PR         *github.PullRequest
+	PR         *forge.PullRequest
+	// Deployment registered for the commit and pending SourceStatus on the source commit, until Report
+	Deployment   *github.Deployment
+	SourceStatus *github.RepoStatus
 }
 
 type State struct {
 	Global   Config
 	orgName  string
 	repoName string
+	// prOrgName and prRepoName of the PR repository, differing from the output repository for forks
+	prOrgName  string
+	prRepoName string
 
-	user    *github.User
+	user    forge.User
 	client  *github.Client
 	gitAuth http.AuthMethod
+	// forge is the API of other forges than GitHub, which use client
+	forge forge.Forge
+
+	// signKey (OpenPGP) or signer (other formats) to sign commits with, if configured
+	signKey *openpgp.Entity
+	signer  gitlogic.Signer
 
 	inputFs billy.Filesystem
 
@@ -61,51 +80,75 @@ func Main(Global Config) (result Result, err error) {
 		return result, errors.Wrap(err, "prepare")
 	}
 
-	// Sync
-	result, err = state.syncBranch()
+	// Sync and auto-merge some syncs, pushing all refs at once
+	var mergeResult Result
+	result, mergeResult, err = state.syncAndMerge()
 	if err != nil {
 		return result, errors.Wrap(err, "sync branch")
 	}
-	htmlUrl := fmt.Sprintf("https://github.com/%s/%s/commit/%s", state.orgName, state.repoName, result.Commit.Hash)
-	defer func() { log.Printf("Browse %s %q", htmlUrl, result.Commit.Message) }()
-
-	// Auto-merge some syncs
-	mergeResult, err := state.merge(result.Commit)
-	if err != nil {
-		return result, errors.Wrap(err, "sync merge")
+	synced := result.Commit
+	if htmlUrl := state.commitURL(synced.Hash); htmlUrl != "" {
+		defer func() { log.Printf("Browse %s %q", htmlUrl, synced.Message) }()
+	}
+	if mergeResult.Commit != nil {
+		if mergeUrl := state.commitURL(mergeResult.Commit.Hash); mergeUrl != "" {
+			defer func() { log.Printf("Browse %s %q", mergeUrl, mergeResult.Commit.Message) }()
+		}
+	}
+	if Global.DryRun {
+		return
 	}
-	defer func() { log.Printf("Browse %s %q", htmlUrl, mergeResult.Commit.Message) }()
 
 	// Create PR for the other syncs
-	result, err = state.pr(result.Commit)
+	result.PR, err = state.pr(result.Commit, result.Previous)
 	if err != nil {
 		return result, errors.Wrap(err, "sync pull request")
 	}
 	if result.PR != nil {
-		defer func() { log.Printf("Browse %s", result.PR.GetHTMLURL()) }()
+		defer func() { log.Printf("Browse %s", result.PR.URL) }()
+	}
+
+	// Wait for the PR to be merged, to wait for the tags to include the merge commit instead
+	if Global.WaitForPRMerge && result.PR != nil {
+		result.Commit, err = state.waitForMerge(context.Background(), result.PR)
+		if err != nil {
+			return result, errors.Wrap(err, "waiting for pull request merge")
+		}
+	}
+
+	if Global.DeploymentEnvironment != "" {
+		result.Deployment, err = state.deploy(result.Commit)
+		if err != nil {
+			return result, errors.Wrap(err, "deployment")
+		}
+	}
+	if Global.SourceStatus != "" {
+		result.SourceStatus, err = state.sourceStatus(result)
+		if err != nil {
+			return result, errors.Wrap(err, "source commit status")
+		}
 	}
 
 	return
 }
 
 func (state *State) fromConfig(Global Config) (err error) {
-	state.orgName, state.repoName, err = githubutil.ParseGitHubRepo(Global.OutputRepoURL)
-	orPanic(errors.WithStack(err), "parsing url")
-
 	state.Global = Global
 	ctx := context.Background()
-	state.client, state.gitAuth, err = Global.GetClientAuth()
-	if err != nil {
-		log.Panic(err)
+	if kind := FirstStr(Global.Forge, ForgeGitHub); kind == ForgeGitHub {
+		state.fromGitHub(ctx)
+	} else if kind == ForgeGit {
+		state.fromGit()
+	} else if contains(Forges, kind) {
+		state.fromForge(ctx, kind)
+	} else {
+		log.Panicf("invalid forge %q, use one of %s", Global.Forge, Forges)
 	}
 
-	// Test auth
-	state.user, _, err = state.client.Users.Get(ctx, "")
-	if err != nil {
-		log.Panic(err)
-	} else {
-		log.Printf("Signed in as %q", state.user.GetLogin())
-		log.Println()
+	if Global.SigningKey != "" {
+		state.signKey, state.signer, err = gitlogic.LoadSigningKey(Global.SigningFormat, Global.SigningKey, Global.SigningKeyPassphrase)
+		orPanic(err, "loading signing key")
+		log.Printf("Signing commits using %s key %s", FirstStr(Global.SigningFormat, gitlogic.SigningFormatOpenPGP), Global.SigningKey)
 	}
 
 	// Prepare output repository
@@ -138,23 +181,235 @@ func (state *State) fromConfig(Global Config) (err error) {
 	return err
 }
 
-func (state State) syncBranch() (result Result, err error) {
+// fromGitHub sets up the GitHub client and signs in
+func (state *State) fromGitHub(ctx context.Context) {
+	Global := state.Global
+	var err error
+	state.orgName, state.repoName, err = githubutil.ParseGitHubRepo(Global.OutputRepoURL)
+	orPanic(errors.WithStack(err), "parsing url")
+	state.prOrgName, state.prRepoName = state.orgName, state.repoName
+	if Global.PrRepoURL != "" {
+		state.prOrgName, state.prRepoName, err = githubutil.ParseGitHubRepo(Global.PrRepoURL)
+		orPanic(errors.WithStack(err), "parsing pr repo url")
+	}
+
+	state.client, state.gitAuth, err = Global.GetClientAuth()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// Test auth
+	user, _, err := state.client.Users.Get(ctx, "")
+	if err != nil {
+		log.Panic(err)
+	}
+	state.user = forge.User{
+		Login: user.GetLogin(),
+		Name:  user.GetName(),
+		Email: FirstStr(user.GetEmail(), fmt.Sprintf("%s@users.noreply.github.com", user.GetLogin())),
+	}
+	log.Printf("Signed in as %q", state.user.Login)
+	log.Println()
+}
+
+// fromForge sets up the API of another forge than GitHub and signs in
+func (state *State) fromForge(ctx context.Context, kind string) {
+	Global := state.Global
+	if flags := unsupportedFlags(kind, Global); len(flags) > 0 {
+		log.Panicf("%s not supported with -forge %s", strings.Join(flags, ", "), kind)
+	}
+	repo, err := forge.ParseRepo(kind, Global.OutputRepoURL, Global.ForgeURL)
+	orPanic(errors.WithStack(err), "parsing url")
+	state.orgName, state.repoName = repo.Owner, repo.Name
+	state.prOrgName, state.prRepoName = repo.Owner, repo.Name
+
+	state.forge, err = forge.New(kind, repo, Global.ForgeToken)
+	orPanic(err, "forge")
+	state.gitAuth, err = Global.GetGitAuth()
+	if err != nil {
+		log.Panic(err)
+	}
+	if kind == ForgeAzure {
+		// Azure DevOps requires multi_ack, which go-git does not advertise. Cloning works when only thin packs are disabled.
+		transport.UnsupportedCapabilities = []capability.Capability{capability.ThinPack}
+	}
+
+	// Test auth
+	user, err := state.forge.CurrentUser(ctx)
+	if err != nil {
+		log.Panic(err)
+	}
+	state.user = *user
+	if state.user.Email == "" {
+		// Bitbucket and Gitea leave out the email of users that keep it private
+		state.user.Email = FirstStr(Global.CommitterEmail, Global.AuthorEmail)
+		if state.user.Email == "" {
+			log.Panicf("%s does not expose the email of %q, set -committer-email (or -author-email) to commit as", repo.BaseURL, state.user.Login)
+		}
+	}
+	log.Printf("Signed in to %s as %q", repo.BaseURL, state.user.Login)
+	log.Println()
+}
+
+// fromGit sets up plain git without forge API, for self-hosted git servers and local repositories
+func (state *State) fromGit() {
+	Global := state.Global
+	if Global.BasePR != "" {
+		log.Panicf("-pr needs the API of a forge to open a pull request, which -forge %s does not use", ForgeGit)
+	}
+	if flags := unsupportedFlags(ForgeGit, Global); len(flags) > 0 {
+		log.Panicf("%s not supported with -forge %s", strings.Join(flags, ", "), ForgeGit)
+	}
+
+	// Without forge there is no authenticated user to commit as
+	state.user = forge.User{
+		Login: FirstStr(Global.CommitterName, Global.AuthorName),
+		Name:  FirstStr(Global.CommitterName, Global.AuthorName),
+		Email: FirstStr(Global.CommitterEmail, Global.AuthorEmail),
+	}
+	if state.user.Login == "" || state.user.Email == "" {
+		log.Panicf("-forge %s needs -committer-name and -committer-email (or -author-name and -author-email) to commit as", ForgeGit)
+	}
+	var err error
+	state.gitAuth, err = Global.GetGitAuth()
+	if err != nil {
+		log.Panic(err)
+	}
+	log.Printf("Committing as %s <%s>", state.user.Name, state.user.Email)
+	log.Println()
+}
+
+// unsupportedFlags lists the flags that are set, but use GitHub specific APIs not available on the forge kind
+func unsupportedFlags(kind string, Global Config) (flags []string) {
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"-pr-repo", Global.PrRepoURL != ""},
+		{"-pr-labels", len(Global.PrLabels) > 0},
+		{"-pr-assignees", len(Global.PrAssignees) > 0},
+		{"-pr-team-reviewers", len(Global.PrTeamReviewers) > 0},
+		{"-pr-milestone", Global.PrMilestone != ""},
+		{"-pr-comment-changes", Global.PrCommentChanges},
+		{"-pr-auto-merge", Global.PrAutoMerge != "" && kind != ForgeAzure},
+		{"-supersede", Global.Supersede},
+		{"-wait-for-pr-merge", Global.WaitForPRMerge},
+		{"-deployment-environment", Global.DeploymentEnvironment != ""},
+		{"-source-status", Global.SourceStatus != ""},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	return flags
+}
+
+// syncAndMerge syncs the head branch, merges it and tags the result (if requested), pushing all refs at once
+// so that a failure cannot leave the head updated but the merge base not
+func (state State) syncAndMerge() (result Result, mergeResult Result, err error) {
+	Global := state.Global
+	err = state.pushRetried(func() []gitlogic.RefUpdate {
+		var updates, mergeUpdates []gitlogic.RefUpdate
+		result, updates = state.prepareSync()
+		mergeResult, mergeUpdates = state.prepareMerge(result.Commit)
+		updates = append(updates, mergeUpdates...)
+		tagged := result.Commit
+		if mergeResult.Commit != nil {
+			tagged = mergeResult.Commit
+		}
+		updates = append(updates, state.prepareTag(tagged, FirstStr(Global.BaseMerge, Global.OutputHead))...)
+		return append(updates, state.prepareNotes(result.Commit, mergeResult.Commit)...)
+	})
+	return result, mergeResult, err
+}
+
+// pushRetried pushes the ref updates made by prepare. When a push is rejected because of a parallel sync,
+// the refs are refetched and prepare is redone on top of the latest refs. Other push errors are not retried,
+// as prepare already moved the local refs: redoing it without refetch would push nothing.
+func (state State) pushRetried(prepare func() []gitlogic.RefUpdate) error {
+	Global := state.Global
+	var failed error
+	err := BackoffRetried(Global.PushRetries, func() error {
+		updates := gitlogic.MergeUpdates(prepare())
+		if Global.DryRun {
+			log.Println("Stopping now because of dry-run")
+			return nil
+		}
+		err := state.push(updates)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, errLeaseRejected) {
+			failed = err
+			return nil
+		}
+		// Recover with refetch, a parallel sync could have pushed the exact same commits
+		orPanic(errors.WithStack(state.refresh(state.syncedRefs(updates)...)), "refetching")
+		if state.isPushed(updates) {
+			log.Println("Updated in parallel sync, already up to date")
+			return nil
+		}
+		log.Printf("Push rejected, retrying on top of the latest refs: %s", err)
+		return err
+	})
+	if failed != nil {
+		return failed
+	}
+	return err
+}
+
+// syncedRefs lists the refs a sync depends on or updates
+func (state State) syncedRefs(updates []gitlogic.RefUpdate) []plumbing.ReferenceName {
+	Global := state.Global
+	names := []plumbing.ReferenceName{
+		plumbing.NewBranchReferenceName(Global.OutputHead),
+		plumbing.NewBranchReferenceName(Global.OutputBase),
+		gitlogic.NotesRef,
+	}
+	if Global.BaseMerge != "" {
+		names = append(names, plumbing.NewBranchReferenceName(Global.BaseMerge))
+	}
+	for _, u := range updates {
+		names = append(names, u.Name)
+	}
+	return names
+}
+
+// isPushed checks whether the (refreshed) local refs already match the updates.
+// The notes are not compared, those of a parallel sync differ in their timestamp only.
+func (state State) isPushed(updates []gitlogic.RefUpdate) bool {
+	for _, u := range updates {
+		if u.Name == gitlogic.NotesRef {
+			continue
+		}
+		ref, err := state.outputRepo.Reference(u.Name, true)
+		if u.New.IsZero() && err != plumbing.ErrReferenceNotFound {
+			return false
+		}
+		if !u.New.IsZero() && (err != nil || ref.Hash() != u.New) {
+			return false
+		}
+	}
+	return true
+}
+
+// prepareSync commits the sync on top of the base and sets the local head ref, returning the ref updates to push
+func (state State) prepareSync() (result Result, updates []gitlogic.RefUpdate) {
 	Global := state.Global
 	headRefName := plumbing.NewBranchReferenceName(Global.OutputHead)
 	baseRefName := plumbing.NewBranchReferenceName(Global.OutputBase)
 
-	var startRef *plumbing.Reference
-	startRef, err = state.outputRepo.Reference(baseRefName, true)
+	startRef, err := state.outputRepo.Reference(baseRefName, true)
 	orPanic(errors.WithStack(err), fmt.Sprintf("base branch %q does not exist, check your inputs", Global.OutputBase))
 
 	log.Printf("Updating HEAD (%s)", Global.OutputHead)
 	headRef, err := state.outputRepo.Reference(headRefName, true)
-	var beforeRefspecs []config.RefSpec = nil
+	headBeforeHash := plumbing.ZeroHash
 	if err == nil {
 		// Reuse existing head branch
 		log.Printf("Using %s as existing head", headRefName)
 		// Store current head for safe push
-		beforeRefspecs = []config.RefSpec{config.RefSpec(fmt.Sprintf("%s:%s", headRef.Hash(), headRefName))}
+		headBeforeHash = headRef.Hash()
 		if headRef.Hash() != startRef.Hash() {
 			// Rebase existing head branch onto sync base by checking out the sync base before doing the sync again
 			log.Printf("Rebasing %s onto %s (commit %s), discarding commit %s", headRef.Name().Short(), startRef.Name().Short(), startRef.Hash(), headRef.Hash())
@@ -176,16 +431,12 @@ func (state State) syncBranch() (result Result, err error) {
 	log.Println()
 
 	// Commit options
-	signature := &object.Signature{
-		Name:  state.user.GetLogin(),
-		Email: firstStr(state.user.GetEmail(), fmt.Sprintf("%s@users.noreply.github.com", state.user.GetLogin())),
-		When:  time.Time(Global.CommitTime),
-	}
-	commitOpt := &git.CommitOptions{Author: signature, Committer: signature}
+	author, committer := state.signatures()
+	commitOpt := &git.CommitOptions{Author: author, Committer: committer, SignKey: state.signKey}
 
 	// Do sync & commit
-	obj := gitlogic.Sync(state.outputRepo, Global.OutputRepoPath, state.inputFs, commitOpt, Global.CommitMsg)
-	result = Result{Commit: obj, Repository: state.outputRepo}
+	obj := gitlogic.Sync(state.outputRepo, Global.OutputRepoPath, state.inputFs, commitOpt, state.commitMsg(Global.CommitMsg), state.signer)
+	result = Result{Commit: obj, Previous: headBeforeHash, Repository: state.outputRepo}
 	log.Println()
 
 	// Update reference
@@ -194,149 +445,263 @@ func (state State) syncBranch() (result Result, err error) {
 	err = state.outputRepo.Storer.SetReference(ref)
 	orPanic(errors.WithStack(err), "creating ref")
 
-	if Global.DryRun {
-		log.Println("Stopping now because of dry-run")
-		return
-	}
-
-	// Push
-	refspec := config.RefSpec(fmt.Sprintf("%s:%s", obj.Hash, headRefName))
-	log.Printf("$ git push %s --force-with-lease\n  leases: %s", refspec, beforeRefspecs)
-	err = state.outputRepo.Push(&git.PushOptions{
-		RefSpecs:          []config.RefSpec{refspec},
-		RequireRemoteRefs: beforeRefspecs,
-		Force:             true,
-		Auth:              state.gitAuth,
-		Progress:          prefixw.New(os.Stderr, "> "),
-	})
-	if err == git.NoErrAlreadyUpToDate {
-		log.Println("Nothing to push, already up to date")
-		err = nil
-	}
-	if err != nil {
-		// Recover untyped error "remote ref refs/heads/... required to be ... but is ..." with refetch
-		_ = state.outputRepo.Fetch(&git.FetchOptions{
-			Auth:     state.gitAuth,
-			Progress: os.Stdout,
-			RefSpecs: []config.RefSpec{config.RefSpec(fmt.Sprintf("%s:%s", headRefName, headRefName))},
-			Depth:    1,
-		})
-		recheckedHeadRef, _ := state.outputRepo.Reference(headRefName, true)
-		if recheckedHeadRef != nil && recheckedHeadRef.Hash() == ref.Hash() {
-			log.Println("Updated in parallel sync, already up to date")
-			err = nil
-		}
-	}
-	orPanic(errors.WithStack(err), "pushing")
-	return
+	updates = []gitlogic.RefUpdate{{Name: headRefName, Old: headBeforeHash, New: obj.Hash}}
+	return result, updates
 }
 
-func (state State) merge(obj *object.Commit) (result Result, err error) {
+// prepareMerge merges obj into the merge base (if requested) and sets the local merge base ref, returning the ref updates to push
+func (state State) prepareMerge(obj *object.Commit) (result Result, updates []gitlogic.RefUpdate) {
 	Global := state.Global
 	headRefName := plumbing.NewBranchReferenceName(Global.OutputHead)
-	orPanic(errors.WithStack(err), "parsing url")
-
-	// Merge if requested
-	if Global.BaseMerge != "" {
-		log.Printf("Updating BASE (%s)", Global.BaseMerge)
-		// Possibly skip making merge if it is a no-op
-		baseMergeRefName := plumbing.ReferenceName(fmt.Sprintf("refs/heads/%s", Global.BaseMerge))
-		baseMergeRef, err := state.outputRepo.Reference(baseMergeRefName, true)
-		orPanic(errors.WithStack(err), "fetching merge base ref")
-		baseMergeBeforeHash := baseMergeRef.Hash()
-		if baseMergeBeforeHash == obj.Hash {
-			log.Println("Skipping merge, already up to date")
-			return result, nil
-		}
+	if Global.BaseMerge == "" {
+		return result, nil
+	}
 
-		// We merge by taking "--theirs" (to prevent issues where re-syncs don't overwrite because the commit already is in upstream)
-		log.Printf("Merging %s into %s...", headRefName.Short(), Global.BaseMerge)
+	log.Printf("Updating BASE (%s)", Global.BaseMerge)
+	// Possibly skip making merge if it is a no-op
+	baseMergeRefName := plumbing.ReferenceName(fmt.Sprintf("refs/heads/%s", Global.BaseMerge))
+	baseMergeRef, err := state.outputRepo.Reference(baseMergeRefName, true)
+	orPanic(errors.WithStack(err), "fetching merge base ref")
+	baseMergeBeforeHash := baseMergeRef.Hash()
+	if baseMergeBeforeHash == obj.Hash {
+		log.Println("Skipping merge, already up to date")
+		return result, state.deleteHead(obj)
+	}
+	baseMergeCommit, err := state.outputRepo.CommitObject(baseMergeBeforeHash)
+	orPanic(errors.WithStack(err), "merge base commit")
+
+	mode := FirstStr(Global.MergeMode, MergeModeMerge)
+	var mergeCommit *object.Commit
+	author, committer := state.signatures()
+	if isAncestor, _ := baseMergeCommit.IsAncestor(obj); mode == MergeModeFastForward && isAncestor {
+		// Fast-forward, no need for a new commit
+		log.Printf("Fast-forwarding %s to %s (%s)...", Global.BaseMerge, headRefName.Short(), obj.Hash)
+		mergeCommit = obj
+	} else {
+		// By default we merge by taking "--theirs" (to prevent issues where re-syncs don't overwrite because the commit already is in upstream)
+		strategy := FirstStr(Global.MergeStrategy, MergeStrategyTheirs)
+		log.Printf("Merging %s into %s (mode %s, strategy %s)...", headRefName.Short(), Global.BaseMerge, mode, strategy)
 
 		// First checkout "ours" (the merge base)
-		state.worktree.Checkout(&git.CheckoutOptions{Hash: baseMergeRef.Hash(), Force: true})
+		err = state.worktree.Checkout(&git.CheckoutOptions{Hash: baseMergeRef.Hash(), Force: true})
 		orPanic(errors.WithStack(err), fmt.Sprintf("worktree checkout to merge base %s (%s)", baseMergeRef.Name().Short(), baseMergeRef.Hash().String()))
 
-		// Draft merge commit opts
-		signature := &object.Signature{
-			Name:  state.user.GetLogin(),
-			Email: firstStr(state.user.GetEmail(), fmt.Sprintf("%s@users.noreply.github.com", state.user.GetLogin())),
-			When:  time.Now(), // use current time
+		// Determine the contents of the output path
+		mergeInputFs := state.inputFs
+		switch strategy {
+		case MergeStrategyOursOutsidePath:
+			// Also take the changes of the head outside the output path, unless the merge branch changed them too
+			if err = gitlogic.MergeOutsidePath(state.worktree.Filesystem, baseMergeCommit, obj, Global.OutputRepoPath); err == nil {
+				mergeInputFs, err = gitlogic.TreeFs(obj, Global.OutputRepoPath)
+			}
+		case MergeStrategyThreeWay:
+			mergeInputFs, err = gitlogic.MergePath(baseMergeCommit, obj, Global.OutputRepoPath)
 		}
-		commitOpt := &git.CommitOptions{
-			Parents:   []plumbing.Hash{baseMergeRef.Hash(), obj.Hash},
-			Author:    signature,
-			Committer: signature,
+		orPanic(err, fmt.Sprintf("merging %s", Global.OutputRepoPath))
+
+		// Draft merge commit opts; squashes only have the merge base as parent
+		msg := fmt.Sprintf("Merge %s into %s", headRefName.Short(), baseMergeRefName.Short())
+		parents := []plumbing.Hash{baseMergeRef.Hash(), obj.Hash}
+		if mode != MergeModeMerge {
+			msg = Global.CommitMsg
+			parents = parents[:1]
 		}
-		// Then sync again by overwriting with our inputFs
-		mergeCommit := gitlogic.Sync(state.outputRepo, Global.OutputRepoPath, state.inputFs, commitOpt, fmt.Sprintf("Merge %s into %s", headRefName.Short(), baseMergeRefName.Short()))
-		result.Commit = mergeCommit // update object to wait for
-
-		// Push
-		refspec := config.RefSpec(fmt.Sprintf("%s:%s", mergeCommit.Hash, baseMergeRefName))
-		beforeRefspecs := []config.RefSpec{config.RefSpec(fmt.Sprintf("%s:%s", baseMergeBeforeHash, baseMergeRefName))}
-		log.Printf("$ git push %s --force-with-lease\n  leases: %s", refspec, beforeRefspecs)
-		err = state.outputRepo.Push(&git.PushOptions{
-			RefSpecs:          []config.RefSpec{refspec},
-			RequireRemoteRefs: beforeRefspecs,
-			Force:             true,
-			Auth:              state.gitAuth,
-			Progress:          prefixw.New(os.Stderr, "> "),
-		})
-		if err == git.NoErrAlreadyUpToDate {
-			err = nil
+		commitOpt := &git.CommitOptions{
+			Parents:   parents,
+			Author:    author,
+			Committer: committer,
+			SignKey:   state.signKey,
 		}
-		orPanic(errors.WithStack(err), "pushing")
-		result.Commit = mergeCommit
+		// Then sync again by overwriting the output path with the merged contents
+		mergeCommit = gitlogic.Sync(state.outputRepo, Global.OutputRepoPath, mergeInputFs, commitOpt, state.commitMsg(msg), state.signer)
 	}
-	return
+	result.Commit = mergeCommit // update object to wait for
+
+	err = state.outputRepo.Storer.SetReference(plumbing.NewHashReference(baseMergeRefName, mergeCommit.Hash))
+	orPanic(errors.WithStack(err), "updating merge base ref")
+	updates = []gitlogic.RefUpdate{{Name: baseMergeRefName, Old: baseMergeBeforeHash, New: mergeCommit.Hash}}
+	updates = append(updates, state.deleteHead(obj)...)
+	return result, updates
 }
 
-func (state State) pr(obj *object.Commit) (result Result, err error) {
-	ctx := context.Background()
+// deleteHead returns the update deleting the head branch after merging obj, if requested
+func (state State) deleteHead(obj *object.Commit) []gitlogic.RefUpdate {
 	Global := state.Global
+	if !Global.DeleteHead || Global.OutputHead == Global.BaseMerge {
+		return nil
+	}
 	headRefName := plumbing.NewBranchReferenceName(Global.OutputHead)
+	headRef, err := state.outputRepo.Reference(headRefName, true)
+	if err != nil || headRef.Hash() != obj.Hash {
+		log.Printf("Keeping %s, it was updated in a parallel sync", headRefName.Short())
+		return nil
+	}
+	log.Printf("Deleting head %s", headRefName.Short())
+	return []gitlogic.RefUpdate{{Name: headRefName, Old: obj.Hash, New: plumbing.ZeroHash}}
+}
 
-	// Pull Request if requested
-	if Global.BasePR != "" {
-		prs, _, err := state.client.PullRequests.List(ctx, state.orgName, state.repoName, &github.PullRequestListOptions{
-			Head:  fmt.Sprintf("%s:%s", state.orgName, headRefName.Short()),
-			Base:  Global.BasePR,
-			State: "open",
-		})
-		orPanic(errors.WithStack(err), "getting existing prs")
-		if len(prs) > 0 {
-			log.Println("Existing PRs:")
-			for _, pr := range prs {
-				log.Println("-", pr.GetHTMLURL())
-				result.PR = pr
-			}
-			return result, nil
+// prepareTag points the release tag (if requested) at commit on branch, returning the update to push the tag with
+func (state State) prepareTag(commit *object.Commit, branch string) []gitlogic.RefUpdate {
+	Global := state.Global
+	if Global.Tag == "" {
+		return nil
+	}
+	data := gitlogic.NewTagData(commit, branch, Global.SourceCommit, Global.SourceRef)
+	name, err := data.TagName(Global.Tag)
+	orPanic(err, "tag name")
+	tagRefName := plumbing.NewTagReferenceName(name)
+
+	beforeHash := plumbing.ZeroHash
+	if existing, err := state.outputRepo.Reference(tagRefName, true); err == nil {
+		if target := gitlogic.TagTarget(state.outputRepo, existing); target == commit.Hash {
+			log.Printf("Tag %s already points to %s", name, commit.Hash)
+			return nil
+		} else if !Global.ForceTag {
+			log.Panicf("tag %s already exists on commit %s, use -force-tag to move it", name, target)
 		}
+		log.Printf("Moving tag %s", name)
+		beforeHash = existing.Hash()
+	}
+
+	// Tags are annotated when a message is set, and always when signing
+	signer := state.signer
+	if signer == nil && state.signKey != nil {
+		signer = &gitlogic.OpenPGPSigner{Entity: state.signKey}
+	}
+	message := Global.TagMessage
+	if message != "" {
+		message, err = data.Expand(message)
+		orPanic(err, "tag message")
+	} else if signer != nil {
+		message = name
+	}
+	_, committer := state.signatures()
+	tagHash, err := gitlogic.CreateTag(state.outputRepo, name, commit.Hash, message, committer, signer)
+	orPanic(errors.WithStack(err), "creating tag")
+	log.Printf("Setting ref %q to %s", tagRefName, tagHash)
+	return []gitlogic.RefUpdate{{Name: tagRefName, Old: beforeHash, New: tagHash}}
+}
+
+// errLeaseRejected marks pushes rejected because a remote ref changed since it was fetched
+var errLeaseRejected = errors.New("remote ref changed")
+
+// push updates the remote refs if they still match the leases (--force-with-lease), atomically if the server supports it
+func (state State) push(updates []gitlogic.RefUpdate) error {
+	if len(updates) == 0 {
+		log.Println("Nothing to push, already up to date")
+		return nil
+	}
+	lines := []string{}
+	for _, u := range updates {
+		lines = append(lines, u.String())
+	}
+	log.Printf("$ git push --atomic --force-with-lease\n  %s", strings.Join(lines, "\n  "))
+	err := gitlogic.Push(context.Background(), state.outputRepo, state.gitAuth, updates, prefixw.New(os.Stderr, "> "))
+	if err != nil && isLeaseRejected(err) {
+		return errors.Wrap(errLeaseRejected, err.Error())
+	}
+	return err
+}
 
-		// Possibly skip making PR if it is a no-op
-		basePRRefName := plumbing.ReferenceName(fmt.Sprintf("refs/heads/%s", Global.BasePR))
-		basePRRef, err := state.outputRepo.Reference(basePRRefName, true)
-		orPanic(errors.WithStack(err), "fetching pr base ref")
-		basePRBeforeHash := basePRRef.Hash()
-		if basePRBeforeHash == obj.Hash {
-			log.Println("Skipping pr, already up to date")
-			return result, nil
+// isLeaseRejected recognizes the untyped errors of the server when a ref was changed since it was fetched,
+// or updated concurrently while pushing
+func isLeaseRejected(err error) bool {
+	for _, msg := range []string{"failed to update ref", "cannot lock ref", "stale info", "atomic push failure", "atomic transaction failed"} {
+		if strings.Contains(err.Error(), msg) {
+			return true
 		}
+	}
+	return false
+}
 
-		prTemplate := github.NewPullRequest{
-			Head:  refStr(headRefName.Short()),
-			Base:  &Global.BasePR,
-			Draft: refBool(true),
-			Body:  &Global.PrBody,
-			Title: refStr(firstStr(Global.PrTitle, Global.CommitMsg)),
+// refresh updates the local refs to their remote state, removing refs that do not exist remotely
+func (state State) refresh(names ...plumbing.ReferenceName) error {
+	remote, err := state.outputRepo.Remote(git.DefaultRemoteName)
+	if err != nil {
+		return err
+	}
+	remoteRefs, err := remote.List(&git.ListOptions{Auth: state.gitAuth})
+	if err != nil {
+		return err
+	}
+	exists := make(map[plumbing.ReferenceName]bool)
+	for _, ref := range remoteRefs {
+		exists[ref.Name()] = true
+	}
+	refspecs := []config.RefSpec{}
+	seen := make(map[plumbing.ReferenceName]bool)
+	for _, name := range names {
+		if seen[name] {
+			continue
 		}
-		result.PR, _, err = state.client.PullRequests.Create(ctx, state.orgName, state.repoName, &prTemplate)
-		if err != nil {
-			return result, err
+		seen[name] = true
+		if exists[name] {
+			refspecs = append(refspecs, config.RefSpec(fmt.Sprintf("+%s:%s", name, name)))
+		} else if err = state.outputRepo.Storer.RemoveReference(name); err != nil {
+			return err
 		}
 	}
+	if len(refspecs) == 0 {
+		return nil
+	}
+	log.Printf("Fetching %s", refspecs)
+	err = state.outputRepo.Fetch(&git.FetchOptions{
+		Auth:     state.gitAuth,
+		RefSpecs: refspecs,
+		Depth:    state.Global.Depth,
+		Force:    true,
+	})
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	return err
+}
 
-	return result, nil
+// signatures returns the author and committer of new commits, by default the authenticated user
+func (state State) signatures() (author *object.Signature, committer *object.Signature) {
+	Global := state.Global
+	committer = &object.Signature{
+		Name:  FirstStr(Global.CommitterName, state.user.Login),
+		Email: FirstStr(Global.CommitterEmail, state.user.Email),
+		When:  time.Time(Global.CommitTime),
+	}
+	author = &object.Signature{
+		Name:  FirstStr(Global.AuthorName, committer.Name),
+		Email: FirstStr(Global.AuthorEmail, committer.Email),
+		When:  time.Time(Global.CommitTime),
+	}
+	return author, committer
+}
+
+// prepareNotes records the provenance of the commits as git notes on top of the fetched notes ref, returning the update
+// to push the notes with. The notes ref is shared by all heads, so a parallel sync of another head makes the push retry.
+func (state State) prepareNotes(commits ...*object.Commit) []gitlogic.RefUpdate {
+	provenance, err := gitlogic.NewProvenance(state.Global, state.inputFs, state.user.Login)
+	orPanic(errors.WithStack(err), "describing provenance")
+	_, committer := state.signatures()
+	before := plumbing.ZeroHash
+	if ref, err := state.outputRepo.Reference(gitlogic.NotesRef, true); err == nil {
+		before = ref.Hash()
+	}
+	notesHash := before
+	noted := make(map[plumbing.Hash]bool)
+	for _, commit := range commits {
+		if commit == nil || noted[commit.Hash] {
+			continue
+		}
+		noted[commit.Hash] = true
+		notesHash, err = gitlogic.AddNote(state.outputRepo, commit.Hash, provenance, committer)
+		orPanic(errors.WithStack(err), "adding provenance note")
+	}
+	if notesHash == before {
+		return nil
+	}
+	return []gitlogic.RefUpdate{{Name: gitlogic.NotesRef, Old: before, New: notesHash}}
+}
+
+// commitMsg adds the source provenance trailers to a commit message
+func (state State) commitMsg(msg string) string {
+	return gitlogic.AppendTrailers(msg, gitlogic.SourceTrailers(state.Global))
 }
 
 func orPanic(err error, ctx string) {
@@ -345,7 +710,22 @@ func orPanic(err error, ctx string) {
 	}
 }
 
+// commitURL is the web page of a commit in the output repository, empty without forge
+func (state State) commitURL(hash plumbing.Hash) string {
+	if state.forge != nil {
+		return state.forge.CommitURL(hash.String())
+	}
+	if state.Global.Forge == ForgeGit {
+		return ""
+	}
+	return fmt.Sprintf("https://github.com/%s/%s/commit/%s", state.orgName, state.repoName, hash)
+}
+
 func maskURL(u string) string {
+	if !strings.Contains(u, "://") {
+		// scp-like URLs and local paths have no password
+		return u
+	}
 	parsed, err := url.Parse(u)
 	orPanic(errors.WithStack(err), "url parsing")
 	if parsed.User == nil {
@@ -366,18 +746,18 @@ func refBool(inp bool) *bool {
 	return &inp
 }
 
-func firstStr(args ...string) string {
-	for _, a := range args {
-		if a != "" {
-			return a
+func contains(list []string, item string) bool {
+	for _, l := range list {
+		if l == item {
+			return true
 		}
 	}
-	return ""
+	return false
 }
 
-// BackoffRetried tries a function 3 times and backs off while retrying
-func BackoffRetried(fn func() error) (err error) {
-	remaining := 3
+// BackoffRetried tries a function and retries it up to retries times, backing off while retrying
+func BackoffRetried(retries int, fn func() error) (err error) {
+	remaining := retries
 	backoff := time.Millisecond * 100
 	for {
 		// try
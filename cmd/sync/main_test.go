@@ -1,15 +1,20 @@
 package sync
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/Q42Philips/gitops-sync/pkg/config"
+	"github.com/Q42Philips/gitops-sync/pkg/gitlogic"
 	"github.com/go-git/go-billy/v5/osfs"
 	"github.com/go-git/go-git/v5"
 	gconfig "github.com/go-git/go-git/v5/config"
@@ -25,29 +30,128 @@ func TestMain(t *testing.T) {
 	state := State{}
 	state.fromTestSetup()
 
-	_, externalURL := prepareExternal()
+	external, externalURL := prepareExternal()
 
 	grp := errgroup.Group{}
 	var result Result
 	var err error
 	grp.Go(func() error {
 		s := state.withFreshInput().withFreshOutput(externalURL)
-		result, err = s.syncBranch()
+		result, _, err = s.syncAndMerge()
 		return err
 	})
 	grp.Go(func() error {
 		s := state.withFreshInput().withFreshOutput(externalURL)
-		result, err = s.syncBranch()
+		result, _, err = s.syncAndMerge()
 		return err
 	})
 	grp.Go(func() error {
 		s := state.withFreshInput().withFreshOutput(externalURL)
-		result, err = s.syncBranch()
+		result, _, err = s.syncAndMerge()
 		return err
 	})
 	err = grp.Wait()
 	orPanic(errors.WithStack(err), "sync")
-	assert.Equal(t, result.Commit.Message, "sync")
+	assert.True(t, strings.HasPrefix(result.Commit.Message, "sync\n\n"))
+	assert.Equal(t, "gitops-sync", gitlogic.ParseTrailers(result.Commit.Message).Get(gitlogic.TrailerSyncedBy))
+	provenance, err := gitlogic.ReadNote(external, result.Commit.Hash)
+	assert.NoError(t, err)
+	assert.Contains(t, provenance.Files, "bases/microservice-a/template.yaml")
+}
+
+// TestMainGit syncs end-to-end into a local repository, without forge
+func TestMainGit(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	state = state.withFreshInput()
+	external, externalURL := prepareExternal()
+	Global := state.Global
+	Global.Forge = config.ForgeGit
+	Global.OutputRepoURL = "file://" + externalURL
+	Global.CommitterName = "GitOps"
+	Global.CommitterEmail = "gitops@example.com"
+
+	result, err := Main(Global)
+	assert.NoError(t, err)
+	head, err := external.Reference(plumbing.NewBranchReferenceName("feature/something"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, result.Commit.Hash, head.Hash())
+	assert.Equal(t, "gitops@example.com", result.Commit.Committer.Email)
+
+	// Pull requests need a forge
+	Global.BasePR = "production"
+	_, err = Main(Global)
+	assert.Error(t, err)
+
+	// -forge-token only authenticates HTTP(S), ssh uses the ssh agent
+	Global.BasePR = ""
+	Global.ForgeToken = "secret"
+	_, err = Main(Global)
+	assert.NoError(t, err)
+	for _, url := range []string{"ssh://git@git.example.com/ops/gitops.git", "git@git.example.com:ops/gitops.git"} {
+		Global := Global
+		Global.OutputRepoURL = url
+		auth, err := Global.GetGitAuth()
+		assert.NoError(t, err)
+		assert.Nil(t, auth, url)
+	}
+	Global.ForgeToken = ""
+
+	// Without forge the identity comes from flags
+	Global.CommitterName, Global.CommitterEmail = "", ""
+	_, err = Main(Global)
+	assert.Error(t, err)
+}
+
+// TestForgeEmail commits with the email from flags when the forge keeps the email of the user private
+func TestForgeEmail(t *testing.T) {
+	log.SetFlags(0)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/user", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"login": "gitops-bot", "full_name": "GitOps", "email": ""}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	state := State{}
+	state.fromTestSetup()
+	state.Global.Forge = config.ForgeGitea
+	state.Global.ForgeURL = server.URL
+	state.Global.ForgeToken = "secret"
+	state.Global.OutputRepoURL = "https://git.example.com/ops/gitops.git"
+	assert.Panics(t, func() { state.fromForge(context.Background(), config.ForgeGitea) })
+
+	state.Global.CommitterEmail = "gitops@example.com"
+	state.fromForge(context.Background(), config.ForgeGitea)
+	_, committer := state.signatures()
+	assert.Equal(t, "gitops-bot", committer.Name)
+	assert.Equal(t, "gitops@example.com", committer.Email)
+}
+
+// TestSyncNotes syncs two heads from clones made before either sync, keeping the notes of both: the second push
+// is rejected on the shared notes ref and retried on top of the notes of the first
+func TestSyncNotes(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	state.Global.PushRetries = 1
+
+	external, externalURL := prepareExternal()
+	first := state.withFreshInput().withFreshOutput(externalURL)
+	second := state.withFreshInput().withFreshOutput(externalURL)
+	second.Global.OutputHead = "feature/other"
+	second.Global.SourceCommit = "def456"
+
+	firstResult, _, err := first.syncAndMerge()
+	assert.NoError(t, err)
+	secondResult, _, err := second.syncAndMerge()
+	assert.NoError(t, err)
+	_, err = gitlogic.ReadNote(external, firstResult.Commit.Hash)
+	assert.NoError(t, err)
+	provenance, err := gitlogic.ReadNote(external, secondResult.Commit.Hash)
+	assert.NoError(t, err)
+	assert.Equal(t, "def456", provenance.SourceCommit)
 }
 
 func (state State) withFreshInput() State {
@@ -104,6 +208,281 @@ func (state *State) fromTestSetup() {
 	}
 	state.orgName = "Q42Philips"
 	state.repoName = "gitops"
+	state.prOrgName, state.prRepoName = state.orgName, state.repoName
 
 	return
 }
+
+// TestMergeThreeWay merges into a merge branch with a concurrent edit of the output path
+func TestMergeThreeWay(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	state.Global.OutputBase = "staging"
+	state.Global.BaseMerge = "production"
+	state.Global.MergeStrategy = config.MergeStrategyThreeWay
+
+	external, externalURL := prepareExternal()
+	production, err := external.Reference(plumbing.NewBranchReferenceName("production"), true)
+	assert.NoError(t, err)
+	orPanic(external.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("staging"), production.Hash())), "branch")
+	commitExternal(external, "production", "bases/microservice-a/concurrent.yaml", "concurrent: true")
+
+	s := state.withFreshInput().withFreshOutput(externalURL)
+	_, merged, err := s.syncAndMerge()
+	assert.NoError(t, err)
+	assert.Len(t, merged.Commit.ParentHashes, 2)
+	for _, name := range []string{"bases/microservice-a/template.yaml", "bases/microservice-a/concurrent.yaml", "README.md"} {
+		_, err = merged.Commit.File(name)
+		assert.NoError(t, err, name)
+	}
+}
+
+// TestMergeStrategies merges a head based on another branch than the merge branch, which only ours-outside-path merges
+// outside the output path
+func TestMergeStrategies(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	state.Global.OutputBase = "staging"
+	state.Global.BaseMerge = "production"
+
+	for _, strategy := range []string{config.MergeStrategyTheirs, config.MergeStrategyOursOutsidePath} {
+		external, externalURL := prepareExternal()
+		production, err := external.Reference(plumbing.NewBranchReferenceName("production"), true)
+		assert.NoError(t, err)
+		orPanic(external.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("staging"), production.Hash())), "branch")
+		commitExternal(external, "staging", "other/config.yaml", "other: true")
+		commitExternal(external, "staging", "README.md", "staging")
+		commitExternal(external, "production", "README.md", "production")
+
+		s := state.withFreshInput().withFreshOutput(externalURL)
+		s.Global.MergeStrategy = strategy
+		_, merged, err := s.syncAndMerge()
+		assert.NoError(t, err, strategy)
+		_, err = merged.Commit.File("bases/microservice-a/template.yaml")
+		assert.NoError(t, err, strategy)
+		readme, err := merged.Commit.File("README.md")
+		assert.NoError(t, err, strategy)
+		contents, _ := readme.Contents()
+		assert.Equal(t, "production", contents, strategy)
+		_, err = merged.Commit.File("other/config.yaml")
+		if strategy == config.MergeStrategyTheirs {
+			assert.Error(t, err, strategy)
+		} else {
+			assert.NoError(t, err, strategy)
+		}
+	}
+}
+
+func commitExternal(repo *git.Repository, branch string, file string, contents string) {
+	w, err := repo.Worktree()
+	orPanic(err, "worktree")
+	orPanic(w.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName(branch), Force: true}), "checkout")
+	orPanic(w.Filesystem.MkdirAll(path.Dir(file), 0777), "mkdir")
+	f, err := w.Filesystem.Create(file)
+	orPanic(err, "create")
+	f.Write([]byte(contents))
+	f.Close()
+	_, err = w.Add(file)
+	orPanic(err, "add")
+	_, err = w.Commit("concurrent", &git.CommitOptions{Author: &object.Signature{Name: "F", Email: "f"}})
+	orPanic(err, "commit")
+}
+
+func TestMergeModes(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	state.Global.BaseMerge = "production"
+	state.Global.MergeMode = config.MergeModeFastForward
+
+	// Head descends from merge base: fast-forward
+	external, externalURL := prepareExternal()
+	s := state.withFreshInput().withFreshOutput(externalURL)
+	result, merged, err := s.syncAndMerge()
+	assert.NoError(t, err)
+	assert.Equal(t, result.Commit.Hash, merged.Commit.Hash)
+	production, err := external.Reference(plumbing.NewBranchReferenceName("production"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, result.Commit.Hash, production.Hash())
+
+	// Diverged: squash
+	orPanic(external.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("staging"), production.Hash())), "branch")
+	commitExternal(external, "staging", "bases/microservice-a/other.yaml", "other: true")
+	commitExternal(external, "production", "README.md", "concurrent")
+	s = s.withFreshOutput(externalURL)
+	s.Global.OutputBase = "staging"
+	orPanic(os.WriteFile(path.Join(s.Global.InputPath, "template.yaml"), []byte(`template: 2`), 0777), "write dummy file")
+	_, merged, err = s.syncAndMerge()
+	assert.NoError(t, err)
+	assert.Len(t, merged.Commit.ParentHashes, 1)
+	assert.True(t, strings.HasPrefix(merged.Commit.Message, "sync\n"))
+}
+
+func TestSyncRetry(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	state.Global.PushRetries = 1
+
+	external, externalURL := prepareExternal()
+	s := state.withFreshInput().withFreshOutput(externalURL)
+
+	// Parallel pipelines update the head and base after we cloned
+	commitExternal(external, "feature/something", "bases/microservice-b/template.yaml", "other: true")
+	commitExternal(external, "production", "README.md", "concurrent")
+	production, err := external.Reference(plumbing.NewBranchReferenceName("production"), true)
+	assert.NoError(t, err)
+
+	result, _, err := s.syncAndMerge()
+	assert.NoError(t, err)
+	assert.Equal(t, []plumbing.Hash{production.Hash()}, result.Commit.ParentHashes)
+	head, err := external.Reference(plumbing.NewBranchReferenceName("feature/something"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, result.Commit.Hash, head.Hash())
+}
+
+// TestSyncPushFailure fails on push errors other than a rejected lease, instead of retrying with nothing to push
+func TestSyncPushFailure(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	state.Global.PushRetries = 1
+
+	_, externalURL := prepareExternal()
+	s := state.withFreshInput().withFreshOutput(externalURL)
+	orPanic(os.RemoveAll(externalURL), "remove external")
+
+	_, _, err := s.syncAndMerge()
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, errLeaseRejected), err)
+}
+
+// TestSyncDirect validates -direct with -merge, pushing the sync commit straight to the merge branch without head branch
+func TestSyncDirect(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	external, externalURL := prepareExternal()
+	state.Global.OutputRepoURL = externalURL
+	state.Global.OutputBase = "develop"
+	state.Global.OutputHead = ""
+	state.Global.BaseMerge = "production"
+	state.Global.Direct = true
+	assert.NoError(t, state.Global.Validate())
+	assert.Equal(t, "production", state.Global.OutputBase)
+	assert.Equal(t, "production", state.Global.OutputHead)
+	assert.Equal(t, "", state.Global.BaseMerge)
+
+	before, err := external.Reference(plumbing.NewBranchReferenceName("production"), true)
+	assert.NoError(t, err)
+	s := state.withFreshInput().withFreshOutput(externalURL)
+	result, merged, err := s.syncAndMerge()
+	assert.NoError(t, err)
+	assert.Nil(t, merged.Commit)
+	assert.Equal(t, []plumbing.Hash{before.Hash()}, result.Commit.ParentHashes)
+	after, err := external.Reference(plumbing.NewBranchReferenceName("production"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, result.Commit.Hash, after.Hash())
+
+	// No head branch is pushed
+	branches, err := external.Branches()
+	assert.NoError(t, err)
+	var names []string
+	orPanic(branches.ForEach(func(ref *plumbing.Reference) error {
+		names = append(names, ref.Name().Short())
+		return nil
+	}), "branches")
+	assert.ElementsMatch(t, []string{"master", "production", "feature/something"}, names)
+}
+
+func TestMergeDeleteHead(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	state.Global.OutputHead = "auto/sync/1"
+	state.Global.BaseMerge = "production"
+	state.Global.DeleteHead = true
+
+	external, externalURL := prepareExternal()
+	s := state.withFreshInput().withFreshOutput(externalURL)
+	_, merged, err := s.syncAndMerge()
+	assert.NoError(t, err)
+	production, err := external.Reference(plumbing.NewBranchReferenceName("production"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, merged.Commit.Hash, production.Hash())
+	_, err = external.Reference(plumbing.NewBranchReferenceName("auto/sync/1"), true)
+	assert.Equal(t, plumbing.ErrReferenceNotFound, err)
+}
+
+func TestSyncAndMergeAtomic(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	state.Global.BaseMerge = "production"
+
+	external, externalURL := prepareExternal()
+	headBefore, err := external.Reference(plumbing.NewBranchReferenceName("feature/something"), true)
+	assert.NoError(t, err)
+	s := state.withFreshInput().withFreshOutput(externalURL)
+
+	// A parallel pipeline updates the merge base after we cloned: the head is not pushed either
+	commitExternal(external, "production", "README.md", "concurrent")
+	_, _, err = s.syncAndMerge()
+	assert.True(t, errors.Is(err, errLeaseRejected), err)
+	head, err := external.Reference(plumbing.NewBranchReferenceName("feature/something"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, headBefore.Hash(), head.Hash())
+	_, err = external.Reference(gitlogic.NotesRef, true)
+	assert.Equal(t, plumbing.ErrReferenceNotFound, err)
+
+	// Retrying on top of the latest merge base pushes both
+	s.Global.PushRetries = 1
+	result, merged, err := s.syncAndMerge()
+	assert.NoError(t, err)
+	head, err = external.Reference(plumbing.NewBranchReferenceName("feature/something"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, result.Commit.Hash, head.Hash())
+	production, err := external.Reference(plumbing.NewBranchReferenceName("production"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, merged.Commit.Hash, production.Hash())
+	for _, commit := range []*object.Commit{result.Commit, merged.Commit} {
+		_, err = gitlogic.ReadNote(external, commit.Hash)
+		assert.NoError(t, err)
+	}
+}
+
+func TestSyncTag(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	state.Global.BaseMerge = "production"
+	state.Global.Tag = "deploy/{{.Branch}}/{{.Time}}"
+	state.Global.TagMessage = "Deploy {{.ShortCommit}}"
+
+	external, externalURL := prepareExternal()
+	s := state.withFreshInput().withFreshOutput(externalURL)
+	_, merged, err := s.syncAndMerge()
+	assert.NoError(t, err)
+	tagRef, err := external.Reference(plumbing.NewTagReferenceName("deploy/production/2006-01-02T03-04-05"), true)
+	assert.NoError(t, err)
+	tag, err := external.TagObject(tagRef.Hash())
+	assert.NoError(t, err)
+	assert.Equal(t, merged.Commit.Hash, tag.Target)
+	assert.Equal(t, fmt.Sprintf("Deploy %s\n", merged.Commit.Hash.String()[:7]), tag.Message)
+
+	// An existing tag is only moved with -force-tag
+	s = s.withFreshOutput(externalURL)
+	orPanic(os.WriteFile(path.Join(s.Global.InputPath, "template.yaml"), []byte(`template: 2`), 0777), "write dummy file")
+	assert.Panics(t, func() { s.syncAndMerge() })
+	s = s.withFreshOutput(externalURL)
+	s.Global.ForceTag = true
+	_, merged, err = s.syncAndMerge()
+	assert.NoError(t, err)
+	tagRef, err = external.Reference(plumbing.NewTagReferenceName("deploy/production/2006-01-02T03-04-05"), true)
+	assert.NoError(t, err)
+	tag, err = external.TagObject(tagRef.Hash())
+	assert.NoError(t, err)
+	assert.Equal(t, merged.Commit.Hash, tag.Target)
+}
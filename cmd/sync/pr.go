@@ -0,0 +1,504 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	. "github.com/Q42Philips/gitops-sync/pkg/config"
+	"github.com/Q42Philips/gitops-sync/pkg/forge"
+	"github.com/Q42Philips/gitops-sync/pkg/githubutil"
+	"github.com/Q42Philips/gitops-sync/pkg/gitlogic"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/google/go-github/v33/github"
+	"github.com/pkg/errors"
+)
+
+// pr creates a pull request from the head into the PR base (if requested), or updates the existing one.
+// previous is the commit the head pointed to before the sync.
+func (state State) pr(obj *object.Commit, previous plumbing.Hash) (*forge.PullRequest, error) {
+	if state.Global.BasePR == "" {
+		return nil, nil
+	}
+	if state.forge != nil {
+		return state.forgePR(obj)
+	}
+	pr, err := state.githubPR(obj, previous)
+	return githubPullRequest(pr), err
+}
+
+// prContent returns the PR base and the rendered body, which includes the marker
+func (state State) prContent(obj *object.Commit) (*plumbing.Reference, string) {
+	basePRRef, err := state.prBase()
+	orPanic(errors.WithStack(err), "fetching pr base ref")
+	body, err := state.prBody(obj, basePRRef.Hash())
+	orPanic(err, "rendering pr body")
+	marker := "\n\n" + state.prMarker()
+	if max := forge.MaxBodyLength(state.Global.Forge); max > 0 {
+		// Truncate before the marker, so the forge stores the body unchanged and the marker is kept
+		body = forge.TruncateBody(body, max-len(marker))
+	}
+	return basePRRef, body + marker
+}
+
+// forgePR creates or updates the pull request on other forges than GitHub
+func (state State) forgePR(obj *object.Commit) (*forge.PullRequest, error) {
+	ctx := context.Background()
+	Global := state.Global
+	basePRRef, body := state.prContent(obj)
+	title := FirstStr(Global.PrTitle, Global.CommitMsg)
+
+	pr, err := state.forge.FindPullRequest(ctx, Global.OutputHead, Global.BasePR)
+	orPanic(errors.WithStack(err), "getting existing prs")
+	if pr != nil {
+		log.Println("Existing PR:", pr.URL)
+		if pr.Title == title && pr.Body == body {
+			return pr, nil
+		}
+		log.Printf("Updating title and body of %s", pr.URL)
+		return pr, state.forge.UpdatePullRequest(ctx, pr, title, body)
+	}
+
+	// Possibly skip making PR if it is a no-op
+	if basePRRef.Hash() == obj.Hash {
+		log.Println("Skipping pr, already up to date")
+		return nil, nil
+	}
+	return state.forge.CreatePullRequest(ctx, forge.NewPullRequest{
+		Head:       Global.OutputHead,
+		Base:       Global.BasePR,
+		Title:      title,
+		Body:       body,
+		Draft:      Global.PrDraft,
+		Reviewers:  Global.PrReviewers,
+		AutoMerge:  Global.PrAutoMerge,
+		DeleteHead: Global.DeleteHead,
+	})
+}
+
+// githubPullRequest converts a GitHub pull request, nil if pr is nil
+func githubPullRequest(pr *github.PullRequest) *forge.PullRequest {
+	if pr == nil {
+		return nil
+	}
+	return &forge.PullRequest{
+		ID:     pr.GetID(),
+		Number: pr.GetNumber(),
+		URL:    pr.GetHTMLURL(),
+		Title:  pr.GetTitle(),
+		Body:   pr.GetBody(),
+		Draft:  pr.GetDraft(),
+	}
+}
+
+// githubPR creates or updates the GitHub pull request, with the GitHub specific extras
+func (state State) githubPR(obj *object.Commit, previous plumbing.Hash) (pr *github.PullRequest, err error) {
+	ctx := context.Background()
+	Global := state.Global
+	headRefName := plumbing.NewBranchReferenceName(Global.OutputHead)
+	head := fmt.Sprintf("%s:%s", state.orgName, headRefName.Short())
+
+	// Pull Request if requested
+	if Global.BasePR != "" {
+		basePRRef, body := state.prContent(obj)
+
+		prs, _, err := state.client.PullRequests.List(ctx, state.prOrgName, state.prRepoName, &github.PullRequestListOptions{
+			Head:  head,
+			Base:  Global.BasePR,
+			State: "open",
+		})
+		orPanic(errors.WithStack(err), "getting existing prs")
+		if len(prs) > 0 {
+			log.Println("Existing PRs:")
+			for _, pr := range prs {
+				log.Println("-", pr.GetHTMLURL())
+			}
+			pr = prs[len(prs)-1]
+			if err = state.updatePR(ctx, pr, obj, previous, body); err != nil {
+				return pr, err
+			}
+			return pr, state.enableAutoMerge(ctx, pr)
+		}
+
+		// Possibly skip making PR if it is a no-op
+		basePRBeforeHash := basePRRef.Hash()
+		if basePRBeforeHash == obj.Hash {
+			log.Println("Skipping pr, already up to date")
+			return nil, nil
+		}
+
+		prTemplate := github.NewPullRequest{
+			Head:  &head,
+			Base:  &Global.BasePR,
+			Draft: refBool(Global.PrDraft),
+			Body:  &body,
+			Title: refStr(FirstStr(Global.PrTitle, Global.CommitMsg)),
+		}
+		pr, _, err = state.client.PullRequests.Create(ctx, state.prOrgName, state.prRepoName, &prTemplate)
+		if err != nil {
+			return nil, err
+		}
+		if err = state.routePR(ctx, pr); err != nil {
+			return pr, err
+		}
+		if Global.Supersede {
+			if err = state.supersede(ctx, pr); err != nil {
+				return pr, err
+			}
+		}
+		return pr, state.enableAutoMerge(ctx, pr)
+	}
+
+	return pr, nil
+}
+
+// updatePR brings an existing PR up to date with the (force-pushed) head
+func (state State) updatePR(ctx context.Context, pr *github.PullRequest, obj *object.Commit, previous plumbing.Hash, body string) error {
+	Global := state.Global
+	title := FirstStr(Global.PrTitle, Global.CommitMsg)
+	if pr.GetTitle() != title || pr.GetBody() != body {
+		log.Printf("Updating title and body of %s", pr.GetHTMLURL())
+		_, _, err := state.client.PullRequests.Edit(ctx, state.prOrgName, state.prRepoName, pr.GetNumber(), &github.PullRequest{Title: &title, Body: &body})
+		if err != nil {
+			return errors.Wrap(err, "updating pr")
+		}
+		pr.Title, pr.Body = &title, &body
+	}
+
+	if Global.PrCommentChanges && !previous.IsZero() && previous != obj.Hash {
+		comment, err := state.changesComment(previous, obj)
+		if err != nil {
+			return errors.Wrap(err, "summarizing changes")
+		}
+		log.Printf("Commenting changes since %s", previous)
+		_, _, err = state.client.Issues.CreateComment(ctx, state.prOrgName, state.prRepoName, pr.GetNumber(), &github.IssueComment{Body: &comment})
+		if err != nil {
+			return errors.Wrap(err, "commenting changes")
+		}
+	}
+
+	if !Global.PrDraft && pr.GetDraft() {
+		return state.markReady(ctx, pr)
+	}
+	return nil
+}
+
+// markReady converts a draft PR to ready for review, which is only possible using GraphQL
+func (state State) markReady(ctx context.Context, pr *github.PullRequest) error {
+	log.Printf("Marking %s ready for review", pr.GetHTMLURL())
+	err := githubutil.GraphQL(ctx, state.client, `mutation($id: ID!) { markPullRequestReadyForReview(input: {pullRequestId: $id}) { clientMutationId } }`,
+		map[string]interface{}{"id": pr.GetNodeID()}, nil)
+	if err != nil {
+		return errors.Wrap(err, "marking pr ready for review")
+	}
+	pr.Draft = refBool(false)
+	return nil
+}
+
+// enableAutoMerge makes GitHub merge the PR once the required reviews and checks pass (-pr-auto-merge).
+// Drafts cannot be merged, so the PR is marked ready for review first.
+func (state State) enableAutoMerge(ctx context.Context, pr *github.PullRequest) error {
+	method := state.Global.PrAutoMerge
+	if method == "" {
+		return nil
+	}
+	if pr.GetDraft() {
+		if err := state.markReady(ctx, pr); err != nil {
+			return err
+		}
+	}
+	log.Printf("Enabling auto-merge (%s) for %s", method, pr.GetHTMLURL())
+	err := githubutil.GraphQL(ctx, state.client, `mutation($id: ID!, $method: PullRequestMergeMethod!) {
+  enablePullRequestAutoMerge(input: {pullRequestId: $id, mergeMethod: $method}) { clientMutationId }
+}`, map[string]interface{}{"id": pr.GetNodeID(), "method": strings.ToUpper(method)}, nil)
+	return errors.Wrap(err, "enabling auto-merge (requires 'Allow auto-merge' in the repository settings)")
+}
+
+// prBodyData is available in -pr-body templates
+type prBodyData struct {
+	*gitlogic.ChangeSummary
+	SourceRepo   string
+	SourceCommit string
+	SourceRef    string
+	PipelineURL  string
+	Commit       string
+	Head         string
+	Base         string
+	OutputPath   string
+}
+
+// prBody renders the -pr-body (or -pr-body-file) template for the changes from base to obj
+func (state State) prBody(obj *object.Commit, base plumbing.Hash) (string, error) {
+	Global := state.Global
+	tmpl := Global.PrBody
+	if Global.PrBodyFile != "" {
+		data, err := ioutil.ReadFile(Global.PrBodyFile)
+		if err != nil {
+			return "", errors.Wrap(err, "reading pr body template")
+		}
+		tmpl = string(data)
+	}
+	t, err := template.New("pr-body").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing pr body template")
+	}
+
+	// Compare with the fork point, like GitHub does
+	from, err := state.outputRepo.CommitObject(base)
+	if err != nil {
+		return "", err
+	}
+	if bases, err := obj.MergeBase(from); err == nil && len(bases) > 0 {
+		from = bases[0]
+	}
+	summary, err := gitlogic.Summarize(from, obj, Global.OutputRepoPath, Global.PrBodyMaxDiff)
+	if err != nil {
+		return "", errors.Wrap(err, "summarizing changes")
+	}
+
+	out := &strings.Builder{}
+	err = t.Execute(out, prBodyData{
+		ChangeSummary: summary,
+		SourceRepo:    Global.SourceRepo,
+		SourceCommit:  Global.SourceCommit,
+		SourceRef:     Global.SourceRef,
+		PipelineURL:   Global.PipelineURL,
+		Commit:        obj.Hash.String(),
+		Head:          Global.OutputHead,
+		Base:          Global.BasePR,
+		OutputPath:    Global.OutputRepoPath,
+	})
+	return out.String(), errors.Wrap(err, "rendering pr body template")
+}
+
+// changesComment describes the files of the output path changed from the previous head to obj
+func (state State) changesComment(previous plumbing.Hash, obj *object.Commit) (string, error) {
+	previousCommit, err := state.outputRepo.CommitObject(previous)
+	if err != nil {
+		return "", err
+	}
+	changes, err := gitlogic.Changes(previousCommit, obj, state.Global.OutputRepoPath)
+	if err != nil {
+		return "", err
+	}
+	synced := obj.Hash.String()
+	if state.Global.SourceCommit != "" {
+		synced = fmt.Sprintf("%s (source %s)", obj.Hash, state.Global.SourceCommit)
+	}
+	comment := &strings.Builder{}
+	fmt.Fprintf(comment, "Synced %s, changes since %s:\n", synced, previous)
+	if len(changes) == 0 {
+		fmt.Fprintf(comment, "\nNo changes in `%s`", state.Global.OutputRepoPath)
+	}
+	for _, change := range changes {
+		fmt.Fprintf(comment, "\n- %s `%s`", change.Status, change.Path)
+	}
+	return comment.String(), nil
+}
+
+// routePR adds the labels, assignees, milestone and requested reviewers to a new PR
+func (state State) routePR(ctx context.Context, pr *github.PullRequest) error {
+	Global := state.Global
+	if len(Global.PrLabels) > 0 {
+		log.Printf("Adding labels %s", Global.PrLabels)
+		if _, _, err := state.client.Issues.AddLabelsToIssue(ctx, state.prOrgName, state.prRepoName, pr.GetNumber(), Global.PrLabels); err != nil {
+			return errors.Wrap(err, "adding labels")
+		}
+	}
+	if len(Global.PrAssignees) > 0 {
+		log.Printf("Assigning %s", Global.PrAssignees)
+		if _, _, err := state.client.Issues.AddAssignees(ctx, state.prOrgName, state.prRepoName, pr.GetNumber(), Global.PrAssignees); err != nil {
+			return errors.Wrap(err, "adding assignees")
+		}
+	}
+	if Global.PrMilestone != "" {
+		milestone, err := state.milestone(ctx, Global.PrMilestone)
+		if err != nil {
+			return err
+		}
+		log.Printf("Adding to milestone %q", milestone.GetTitle())
+		if _, _, err = state.client.Issues.Edit(ctx, state.prOrgName, state.prRepoName, pr.GetNumber(), &github.IssueRequest{Milestone: milestone.Number}); err != nil {
+			return errors.Wrap(err, "setting milestone")
+		}
+	}
+	if len(Global.PrReviewers) > 0 || len(Global.PrTeamReviewers) > 0 {
+		log.Printf("Requesting reviews from %s", append(append([]string{}, Global.PrReviewers...), Global.PrTeamReviewers...))
+		_, _, err := state.client.PullRequests.RequestReviewers(ctx, state.prOrgName, state.prRepoName, pr.GetNumber(), github.ReviewersRequest{
+			Reviewers:     Global.PrReviewers,
+			TeamReviewers: Global.PrTeamReviewers,
+		})
+		if err != nil {
+			return errors.Wrap(err, "requesting reviewers")
+		}
+	}
+	return nil
+}
+
+// milestone finds an open milestone by number or title
+func (state State) milestone(ctx context.Context, numberOrTitle string) (*github.Milestone, error) {
+	if number, err := strconv.Atoi(numberOrTitle); err == nil {
+		milestone, _, err := state.client.Issues.GetMilestone(ctx, state.prOrgName, state.prRepoName, number)
+		return milestone, errors.Wrapf(err, "getting milestone %d", number)
+	}
+	opt := &github.MilestoneListOptions{State: "open", ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		milestones, resp, err := state.client.Issues.ListMilestones(ctx, state.prOrgName, state.prRepoName, opt)
+		if err != nil {
+			return nil, errors.Wrap(err, "listing milestones")
+		}
+		for _, milestone := range milestones {
+			if milestone.GetTitle() == numberOrTitle {
+				return milestone, nil
+			}
+		}
+		if resp.NextPage == 0 {
+			return nil, errors.Errorf("no open milestone %q", numberOrTitle)
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// prMarker is a hidden comment in the body identifying the sync PRs of the output path
+func (state State) prMarker() string {
+	return fmt.Sprintf("<!-- gitops-sync path=%s -->", path.Clean(state.Global.OutputRepoPath))
+}
+
+// supersede closes the other open sync PRs of the output path into the same base, pointing to pr
+func (state State) supersede(ctx context.Context, pr *github.PullRequest) error {
+	Global := state.Global
+	opt := &github.PullRequestListOptions{State: "open", Base: Global.BasePR, ListOptions: github.ListOptions{PerPage: 100}}
+	var superseded []*github.PullRequest
+	for {
+		prs, resp, err := state.client.PullRequests.List(ctx, state.prOrgName, state.prRepoName, opt)
+		if err != nil {
+			return errors.Wrap(err, "listing open prs")
+		}
+		for _, other := range prs {
+			if other.GetNumber() != pr.GetNumber() && strings.Contains(other.GetBody(), state.prMarker()) {
+				superseded = append(superseded, other)
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+
+	var deletes []gitlogic.RefUpdate
+	for _, other := range superseded {
+		log.Printf("Closing %s, superseded by %s", other.GetHTMLURL(), pr.GetHTMLURL())
+		comment := fmt.Sprintf("Superseded by %s", pr.GetHTMLURL())
+		if _, _, err := state.client.Issues.CreateComment(ctx, state.prOrgName, state.prRepoName, other.GetNumber(), &github.IssueComment{Body: &comment}); err != nil {
+			return errors.Wrapf(err, "commenting on #%d", other.GetNumber())
+		}
+		if _, _, err := state.client.PullRequests.Edit(ctx, state.prOrgName, state.prRepoName, other.GetNumber(), &github.PullRequest{State: refStr("closed")}); err != nil {
+			return errors.Wrapf(err, "closing #%d", other.GetNumber())
+		}
+		if Global.SupersedeDeleteHead && other.GetHead().GetRepo().GetFullName() == fmt.Sprintf("%s/%s", state.orgName, state.repoName) {
+			deletes = append(deletes, gitlogic.RefUpdate{
+				Name: plumbing.NewBranchReferenceName(other.GetHead().GetRef()),
+				Old:  plumbing.NewHash(other.GetHead().GetSHA()),
+				New:  plumbing.ZeroHash,
+			})
+		}
+	}
+	if len(deletes) > 0 {
+		return errors.Wrap(state.push(deletes), "deleting superseded heads")
+	}
+	return nil
+}
+
+// upstreamRemote is the remote name of -pr-repo, when the output repository is a fork of it
+const upstreamRemote = "upstream"
+
+// isFork tells whether the PR is opened in another repository (-pr-repo) than the head is pushed to
+func (state State) isFork() bool {
+	return state.prOrgName != state.orgName || state.prRepoName != state.repoName
+}
+
+// prBase returns the PR base ref. For forks it is fetched from -pr-repo into refs/remotes/upstream/<base>,
+// as the base in the fork may lag behind.
+func (state State) prBase() (*plumbing.Reference, error) {
+	Global := state.Global
+	if !state.isFork() {
+		return state.outputRepo.Reference(plumbing.NewBranchReferenceName(Global.BasePR), true)
+	}
+	name := plumbing.NewRemoteReferenceName(upstreamRemote, Global.BasePR)
+	remote := git.NewRemote(state.outputRepo.Storer, &config.RemoteConfig{Name: upstreamRemote, URLs: []string{Global.PrRepoURL}})
+	err := remote.Fetch(&git.FetchOptions{
+		Auth:     state.gitAuth,
+		RefSpecs: []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", plumbing.NewBranchReferenceName(Global.BasePR), name))},
+		Depth:    Global.Depth,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, errors.Wrapf(err, "fetching %s from %s", Global.BasePR, maskURL(Global.PrRepoURL))
+	}
+	return state.outputRepo.Reference(name, true)
+}
+
+// prPollInterval is the time between checks whether the PR is merged
+var prPollInterval = 10 * time.Second
+
+// waitForMerge polls the PR until it is merged (or fails if closed or timed out), returning the merge commit fetched from the PR base
+func (state State) waitForMerge(ctx context.Context, merging *forge.PullRequest) (*object.Commit, error) {
+	Global := state.Global
+	ctx, cancel := context.WithTimeout(ctx, Global.PRMergeTimeout)
+	defer cancel()
+
+	log.Printf("Waiting for %s to be merged (timeout %s)", merging.URL, Global.PRMergeTimeout)
+	var pr *github.PullRequest
+	for {
+		var err error
+		pr, _, err = state.client.PullRequests.Get(ctx, state.prOrgName, state.prRepoName, merging.Number)
+		if err != nil {
+			return nil, errors.Wrap(err, "getting pr")
+		}
+		if pr.GetMerged() {
+			break
+		}
+		if pr.GetState() == "closed" {
+			return nil, errors.Errorf("%s was closed without merging", pr.GetHTMLURL())
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errors.Errorf("%s was not merged within %s", pr.GetHTMLURL(), Global.PRMergeTimeout)
+		case <-time.After(prPollInterval):
+		}
+	}
+
+	mergeHash := plumbing.NewHash(pr.GetMergeCommitSHA())
+	log.Printf("Merged %s as %s", pr.GetHTMLURL(), mergeHash)
+	if Global.DeleteHead {
+		state.deleteMergedHead(pr)
+	}
+	if state.isFork() {
+		_, err := state.prBase()
+		if err != nil {
+			return nil, errors.Wrap(err, "fetching pr base")
+		}
+	} else if err := state.refresh(plumbing.NewBranchReferenceName(Global.BasePR)); err != nil {
+		return nil, errors.Wrap(err, "fetching pr base")
+	}
+	commit, err := state.outputRepo.CommitObject(mergeHash)
+	return commit, errors.Wrap(err, "merge commit")
+}
+
+// deleteMergedHead deletes the head branch of the merged pr (-delete-head-after-merge), unless it was updated since.
+// The PR is merged already, so failing is not fatal.
+func (state State) deleteMergedHead(pr *github.PullRequest) {
+	headRefName := plumbing.NewBranchReferenceName(state.Global.OutputHead)
+	log.Printf("Deleting head %s", headRefName.Short())
+	err := state.push([]gitlogic.RefUpdate{{Name: headRefName, Old: plumbing.NewHash(pr.GetHead().GetSHA()), New: plumbing.ZeroHash}})
+	if err != nil {
+		log.Printf("Warning: keeping %s: %s", headRefName.Short(), err)
+	}
+}
@@ -0,0 +1,448 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Q42Philips/gitops-sync/pkg/config"
+	"github.com/Q42Philips/gitops-sync/pkg/forge"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/google/go-github/v33/github"
+	"github.com/stretchr/testify/assert"
+)
+
+// githubStub points the state's GitHub client at a test server
+func (state *State) githubStub(t *testing.T) *http.ServeMux {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	state.client = github.NewClient(nil)
+	state.client.BaseURL, _ = url.Parse(server.URL + "/")
+	return mux
+}
+
+// recordJSON handles path by recording the request body and responding with response
+func recordJSON(mux *http.ServeMux, path string, requests *[]map[string]interface{}, response string) {
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		request := map[string]interface{}{"method": r.Method}
+		json.Unmarshal(body, &request)
+		*requests = append(*requests, request)
+		fmt.Fprint(w, response)
+	})
+}
+
+func TestRoutePR(t *testing.T) {
+	state := State{}
+	state.fromTestSetup()
+	state.Global.PrLabels.Set("gitops,production")
+	state.Global.PrAssignees.Set("alice")
+	state.Global.PrReviewers.Set("bob")
+	state.Global.PrTeamReviewers.Set("platform")
+	state.Global.PrMilestone = "Sprint 42"
+	mux := state.githubStub(t)
+
+	var assignees, issue, reviewers []map[string]interface{}
+	var labels []string
+	mux.HandleFunc("/repos/Q42Philips/gitops/issues/5/labels", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&labels)
+		fmt.Fprint(w, `[]`)
+	})
+	recordJSON(mux, "/repos/Q42Philips/gitops/issues/5/assignees", &assignees, `{}`)
+	recordJSON(mux, "/repos/Q42Philips/gitops/issues/5", &issue, `{}`)
+	recordJSON(mux, "/repos/Q42Philips/gitops/pulls/5/requested_reviewers", &reviewers, `{}`)
+	mux.HandleFunc("/repos/Q42Philips/gitops/milestones", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"number": 1, "title": "Sprint 41"}, {"number": 2, "title": "Sprint 42"}]`)
+	})
+
+	err := state.routePR(context.Background(), &github.PullRequest{Number: github.Int(5)})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"gitops", "production"}, labels)
+	if assert.Len(t, assignees, 1) {
+		assert.Equal(t, []interface{}{"alice"}, assignees[0]["assignees"])
+	}
+	if assert.Len(t, issue, 1) {
+		assert.Equal(t, float64(2), issue[0]["milestone"])
+	}
+	if assert.Len(t, reviewers, 1) {
+		assert.Equal(t, []interface{}{"bob"}, reviewers[0]["reviewers"])
+		assert.Equal(t, []interface{}{"platform"}, reviewers[0]["team_reviewers"])
+	}
+}
+
+func TestUpdatePR(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	state.Global.PrDraft = false
+	state.Global.PrCommentChanges = true
+	_, externalURL := prepareExternal()
+	s := state.withFreshInput().withFreshOutput(externalURL)
+	first, _, err := s.syncAndMerge()
+	assert.NoError(t, err)
+	orPanic(os.WriteFile(path.Join(s.Global.InputPath, "other.yaml"), []byte(`other: 1`), 0777), "write dummy file")
+	second, _, err := s.syncAndMerge()
+	assert.NoError(t, err)
+	assert.Equal(t, first.Commit.Hash, second.Previous)
+
+	mux := s.githubStub(t)
+	var edits, comments, graphql []map[string]interface{}
+	recordJSON(mux, "/repos/Q42Philips/gitops/pulls/7", &edits, `{}`)
+	recordJSON(mux, "/repos/Q42Philips/gitops/issues/7/comments", &comments, `{}`)
+	recordJSON(mux, "/graphql", &graphql, `{"data": {}}`)
+
+	pr := &github.PullRequest{Number: github.Int(7), NodeID: github.String("PR_7"), Title: github.String("old"), Draft: github.Bool(true)}
+	err = s.updatePR(context.Background(), pr, second.Commit, second.Previous, "body")
+	assert.NoError(t, err)
+	if assert.Len(t, edits, 1) {
+		assert.Equal(t, "title", edits[0]["title"])
+		assert.Equal(t, "body", edits[0]["body"])
+	}
+	if assert.Len(t, comments, 1) {
+		assert.Contains(t, comments[0]["body"], "- added `bases/microservice-a/other.yaml`")
+	}
+	if assert.Len(t, graphql, 1) {
+		assert.Equal(t, map[string]interface{}{"id": "PR_7"}, graphql[0]["variables"])
+	}
+	assert.False(t, pr.GetDraft())
+}
+
+func TestPRBody(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	state.Global.BasePR = "production"
+	state.Global.SourceCommit = "abc123"
+	state.Global.PrBodyMaxDiff = 10000
+	state.Global.PrBody = `Sync of {{.SourceCommit}} into {{.Base}}
+{{range .Files}}
+- {{.Status}} {{.Path}}{{end}}
+{{range .Directories}}
+{{.Path}}: +{{.Added}} ~{{.Modified}} -{{.Deleted}}{{end}}
+{{if .DiffTruncated}}truncated{{end}}`
+	external, externalURL := prepareExternal()
+	s := state.withFreshInput().withFreshOutput(externalURL)
+	result, _, err := s.syncAndMerge()
+	assert.NoError(t, err)
+	base, err := external.Reference(plumbing.NewBranchReferenceName("production"), true)
+	assert.NoError(t, err)
+
+	body, err := s.prBody(result.Commit, base.Hash())
+	assert.NoError(t, err)
+	assert.Equal(t, `Sync of abc123 into production
+
+- added bases/microservice-a/template.yaml
+
+bases/microservice-a: +1 ~0 -0
+`, body)
+
+	s.Global.PrBody = "{{.Unknown}}"
+	_, err = s.prBody(result.Commit, base.Hash())
+	assert.Error(t, err)
+}
+
+func TestEnableAutoMerge(t *testing.T) {
+	state := State{}
+	state.fromTestSetup()
+	state.Global.PrAutoMerge = "squash"
+	mux := state.githubStub(t)
+	var graphql []map[string]interface{}
+	recordJSON(mux, "/graphql", &graphql, `{"data": {}}`)
+
+	pr := &github.PullRequest{Number: github.Int(7), NodeID: github.String("PR_7"), Draft: github.Bool(true)}
+	err := state.enableAutoMerge(context.Background(), pr)
+	assert.NoError(t, err)
+	if assert.Len(t, graphql, 2) {
+		assert.Contains(t, graphql[0]["query"], "markPullRequestReadyForReview")
+		assert.Contains(t, graphql[1]["query"], "enablePullRequestAutoMerge")
+		assert.Equal(t, map[string]interface{}{"id": "PR_7", "method": "SQUASH"}, graphql[1]["variables"])
+	}
+	assert.False(t, pr.GetDraft())
+}
+
+func TestWaitForMerge(t *testing.T) {
+	log.SetFlags(0)
+	defer func(interval time.Duration) { prPollInterval = interval }(prPollInterval)
+	prPollInterval = time.Millisecond
+	state := State{}
+	state.fromTestSetup()
+	state.Global.BasePR = "production"
+	state.Global.PRMergeTimeout = time.Second
+	external, externalURL := prepareExternal()
+	s := state.withFreshInput().withFreshOutput(externalURL)
+	head, err := external.Reference(plumbing.NewBranchReferenceName("feature/something"), true)
+	assert.NoError(t, err)
+
+	// The PR is merged after a few polls, and its head deleted
+	s.Global.DeleteHead = true
+	commitExternal(external, "production", "bases/microservice-a/template.yaml", "merged: true")
+	merged, err := external.Reference(plumbing.NewBranchReferenceName("production"), true)
+	assert.NoError(t, err)
+	mux := s.githubStub(t)
+	polls := 0
+	mux.HandleFunc("/repos/Q42Philips/gitops/pulls/7", func(w http.ResponseWriter, r *http.Request) {
+		if polls++; polls < 3 {
+			fmt.Fprint(w, `{"number": 7, "state": "open"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"number": 7, "state": "closed", "merged": true, "merge_commit_sha": "%s", "head": {"sha": "%s"}}`, merged.Hash(), head.Hash())
+	})
+	commit, err := s.waitForMerge(context.Background(), &forge.PullRequest{Number: 7})
+	assert.NoError(t, err)
+	assert.Equal(t, merged.Hash(), commit.Hash)
+	assert.Equal(t, 3, polls)
+	_, err = external.Reference(plumbing.NewBranchReferenceName("feature/something"), true)
+	assert.Equal(t, plumbing.ErrReferenceNotFound, err)
+	s.Global.DeleteHead = false
+
+	// Closed without merging
+	mux.HandleFunc("/repos/Q42Philips/gitops/pulls/8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"number": 8, "state": "closed"}`)
+	})
+	_, err = s.waitForMerge(context.Background(), &forge.PullRequest{Number: 8})
+	assert.Error(t, err)
+
+	// Timeout
+	s.Global.PRMergeTimeout = 10 * time.Millisecond
+	mux.HandleFunc("/repos/Q42Philips/gitops/pulls/9", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"number": 9, "state": "open"}`)
+	})
+	_, err = s.waitForMerge(context.Background(), &forge.PullRequest{Number: 9})
+	assert.Error(t, err)
+}
+
+func TestSupersede(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	state.Global.BasePR = "production"
+	state.Global.SupersedeDeleteHead = true
+	external, externalURL := prepareExternal()
+	s := state.withFreshInput().withFreshOutput(externalURL)
+	old, err := external.Reference(plumbing.NewBranchReferenceName("feature/something"), true)
+	assert.NoError(t, err)
+
+	mux := s.githubStub(t)
+	mux.HandleFunc("/repos/Q42Philips/gitops/pulls", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "production", r.URL.Query().Get("base"))
+		fmt.Fprintf(w, `[
+			{"number": 7, "body": "new\n\n%[1]s"},
+			{"number": 6, "body": "old\n\n%[1]s", "head": {"ref": "feature/something", "sha": "%[2]s", "repo": {"full_name": "Q42Philips/gitops"}}},
+			{"number": 5, "body": "other\n\n<!-- gitops-sync path=bases/other -->"},
+			{"number": 4, "body": "manual"}
+		]`, s.prMarker(), old.Hash())
+	})
+	var edits, comments []map[string]interface{}
+	recordJSON(mux, "/repos/Q42Philips/gitops/pulls/6", &edits, `{}`)
+	recordJSON(mux, "/repos/Q42Philips/gitops/issues/6/comments", &comments, `{}`)
+
+	err = s.supersede(context.Background(), &github.PullRequest{Number: github.Int(7), HTMLURL: github.String("https://github.com/Q42Philips/gitops/pull/7")})
+	assert.NoError(t, err)
+	if assert.Len(t, comments, 1) {
+		assert.Equal(t, "Superseded by https://github.com/Q42Philips/gitops/pull/7", comments[0]["body"])
+	}
+	if assert.Len(t, edits, 1) {
+		assert.Equal(t, "closed", edits[0]["state"])
+	}
+	_, err = external.Reference(plumbing.NewBranchReferenceName("feature/something"), true)
+	assert.Equal(t, plumbing.ErrReferenceNotFound, err)
+}
+
+func TestSupersedeFork(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	state.Global.BasePR = "production"
+	state.Global.SupersedeDeleteHead = true
+	state.prOrgName = "Upstream"
+	external, externalURL := prepareExternal()
+	s := state.withFreshInput().withFreshOutput(externalURL)
+	old, err := external.Reference(plumbing.NewBranchReferenceName("feature/something"), true)
+	assert.NoError(t, err)
+	production, err := external.Reference(plumbing.NewBranchReferenceName("production"), true)
+	assert.NoError(t, err)
+
+	// Heads are pushed to the fork, so only #6 has its head deleted
+	mux := s.githubStub(t)
+	mux.HandleFunc("/repos/Upstream/gitops/pulls", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `[
+			{"number": 7, "body": "new\n\n%[1]s"},
+			{"number": 6, "body": "old\n\n%[1]s", "head": {"ref": "feature/something", "sha": "%[2]s", "repo": {"full_name": "Q42Philips/gitops"}}},
+			{"number": 5, "body": "upstream\n\n%[1]s", "head": {"ref": "production", "sha": "%[3]s", "repo": {"full_name": "Upstream/gitops"}}}
+		]`, s.prMarker(), old.Hash(), production.Hash())
+	})
+	var edits, comments []map[string]interface{}
+	recordJSON(mux, "/repos/Upstream/gitops/pulls/6", &edits, `{}`)
+	recordJSON(mux, "/repos/Upstream/gitops/pulls/5", &edits, `{}`)
+	recordJSON(mux, "/repos/Upstream/gitops/issues/6/comments", &comments, `{}`)
+	recordJSON(mux, "/repos/Upstream/gitops/issues/5/comments", &comments, `{}`)
+
+	err = s.supersede(context.Background(), &github.PullRequest{Number: github.Int(7), HTMLURL: github.String("https://github.com/Upstream/gitops/pull/7")})
+	assert.NoError(t, err)
+	assert.Len(t, comments, 2)
+	assert.Len(t, edits, 2)
+	_, err = external.Reference(plumbing.NewBranchReferenceName("feature/something"), true)
+	assert.Equal(t, plumbing.ErrReferenceNotFound, err)
+	_, err = external.Reference(plumbing.NewBranchReferenceName("production"), true)
+	assert.NoError(t, err)
+}
+
+func TestForkPR(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	state.Global.BasePR = "production"
+	upstream, upstreamURL := prepareExternal()
+	forkURL, _ := os.MkdirTemp(os.TempDir(), "fork")
+	fork, err := git.PlainClone(forkURL, false, &git.CloneOptions{URL: upstreamURL})
+	assert.NoError(t, err)
+	initial, err := upstream.Reference(plumbing.NewBranchReferenceName("production"), true)
+	assert.NoError(t, err)
+	orPanic(fork.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("production"), initial.Hash())), "branch")
+	orPanic(fork.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("feature/something"), initial.Hash())), "branch")
+
+	// The base in the fork lags behind upstream
+	commitExternal(upstream, "production", "bases/microservice-a/upstream.yaml", "upstream: true")
+	base, err := upstream.Reference(plumbing.NewBranchReferenceName("production"), true)
+	assert.NoError(t, err)
+
+	state.Global.PrRepoURL = upstreamURL
+	state.prOrgName = "Upstream"
+	s := state.withFreshInput().withFreshOutput(forkURL)
+	result, _, err := s.syncAndMerge()
+	assert.NoError(t, err)
+
+	mux := s.githubStub(t)
+	var created []map[string]interface{}
+	mux.HandleFunc("/repos/Upstream/gitops/pulls", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			assert.Equal(t, "Q42Philips:feature/something", r.URL.Query().Get("head"))
+			fmt.Fprint(w, `[]`)
+			return
+		}
+		var request map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&request)
+		created = append(created, request)
+		fmt.Fprint(w, `{"number": 3}`)
+	})
+
+	pr, err := s.pr(result.Commit, result.Previous)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, pr.Number)
+	if assert.Len(t, created, 1) {
+		assert.Equal(t, "Q42Philips:feature/something", created[0]["head"])
+		assert.Equal(t, "production", created[0]["base"])
+	}
+	fetched, err := s.outputRepo.Reference(plumbing.NewRemoteReferenceName(upstreamRemote, "production"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, base.Hash(), fetched.Hash())
+}
+
+func TestForgePR(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	state.Global.BasePR = "production"
+	state.Global.PrDraft = true
+	_, externalURL := prepareExternal()
+	s := state.withFreshInput().withFreshOutput(externalURL)
+	result, _, err := s.syncAndMerge()
+	assert.NoError(t, err)
+
+	var created []map[string]interface{}
+	existing := `[]`
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/repos/Q42Philips/gitops/pulls", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			if r.URL.Query().Get("page") == "1" {
+				fmt.Fprint(w, existing)
+			} else {
+				fmt.Fprint(w, `[]`)
+			}
+			return
+		}
+		var request map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&request)
+		created = append(created, request)
+		fmt.Fprint(w, `{"number": 3, "html_url": "https://gitea/pulls/3"}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	s.forge = forge.NewGitea(forge.Repo{BaseURL: server.URL, Owner: "Q42Philips", Name: "gitops"}, "token")
+
+	pr, err := s.pr(result.Commit, result.Previous)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://gitea/pulls/3", pr.URL)
+	if assert.Len(t, created, 1) {
+		assert.Equal(t, "feature/something", created[0]["head"])
+		assert.Equal(t, "WIP: title", created[0]["title"])
+		assert.Contains(t, created[0]["body"], s.prMarker())
+	}
+
+	// An up to date pull request is left as is
+	existing = fmt.Sprintf(`[{"number": 3, "title": "WIP: title", "body": %q, "head": {"ref": "feature/something"}, "base": {"ref": "production"}}]`, created[0]["body"])
+	pr, err = s.pr(result.Commit, result.Previous)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, pr.Number)
+	assert.Len(t, created, 1)
+}
+
+// TestForgePRTruncated keeps the marker when a long body is truncated to the description limit of Azure DevOps
+func TestForgePRTruncated(t *testing.T) {
+	log.SetFlags(0)
+	state := State{}
+	state.fromTestSetup()
+	state.Global.Forge = config.ForgeAzure
+	state.Global.BasePR = "production"
+	state.Global.PrBody = strings.Repeat("x", 5000)
+	_, externalURL := prepareExternal()
+	s := state.withFreshInput().withFreshOutput(externalURL)
+	result, _, err := s.syncAndMerge()
+	assert.NoError(t, err)
+
+	var created, updated []map[string]interface{}
+	existing := `{"value": []}`
+	mux := http.NewServeMux()
+	mux.HandleFunc("/contoso/Platform/_apis/git/repositories/gitops/pullrequests", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			fmt.Fprint(w, existing)
+			return
+		}
+		var request map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&request)
+		created = append(created, request)
+		fmt.Fprint(w, `{"pullRequestId": 3}`)
+	})
+	recordJSON(mux, "/contoso/Platform/_apis/git/repositories/gitops/pullrequests/3", &updated, `{"pullRequestId": 3}`)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	s.forge = forge.NewAzure(forge.Repo{BaseURL: server.URL + "/contoso", Owner: "Platform", Name: "gitops"}, "token")
+
+	_, err = s.pr(result.Commit, result.Previous)
+	assert.NoError(t, err)
+	if !assert.Len(t, created, 1) {
+		return
+	}
+	body := created[0]["description"].(string)
+	assert.Len(t, body, forge.MaxBodyLength(config.ForgeAzure))
+	assert.True(t, strings.HasSuffix(body, "\n\n"+s.prMarker()))
+
+	// The truncated pull request is up to date
+	existing = fmt.Sprintf(`{"value": [{"pullRequestId": 3, "title": "title", "description": %q}]}`, body)
+	_, err = s.pr(result.Commit, result.Previous)
+	assert.NoError(t, err)
+	assert.Len(t, created, 1)
+	assert.Len(t, updated, 0)
+}
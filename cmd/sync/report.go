@@ -0,0 +1,106 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	. "github.com/Q42Philips/gitops-sync/pkg/config"
+	"github.com/Q42Philips/gitops-sync/pkg/githubutil"
+	"github.com/google/go-github/v33/github"
+	"github.com/pkg/errors"
+)
+
+// Report sets the outcome of the sync and of waiting for the tags (outcome, nil on success)
+// on the result's deployment and source commit status
+func Report(Global Config, result Result, outcome error) (err error) {
+	if result.Deployment == nil && result.SourceStatus == nil {
+		return nil
+	}
+	state := State{Global: Global}
+	if state.orgName, state.repoName, err = githubutil.ParseGitHubRepo(Global.OutputRepoURL); err != nil {
+		return errors.Wrap(err, "parsing url")
+	}
+	state.prOrgName, state.prRepoName = state.orgName, state.repoName
+	if Global.PrRepoURL != "" {
+		if state.prOrgName, state.prRepoName, err = githubutil.ParseGitHubRepo(Global.PrRepoURL); err != nil {
+			return errors.Wrap(err, "parsing pr repo url")
+		}
+	}
+	if state.client, _, err = Global.GetClientAuth(); err != nil {
+		return err
+	}
+	return state.report(context.Background(), result, outcome)
+}
+
+// report sets both statuses even if one of them fails, returning the combined error
+func (state State) report(ctx context.Context, result Result, outcome error) error {
+	status := "success"
+	if outcome != nil {
+		status = "failure"
+	}
+	var messages []string
+	if result.Deployment != nil {
+		log.Printf("Marking deployment to %s as %s", result.Deployment.GetEnvironment(), status)
+		if err := state.deploymentStatus(ctx, result.Deployment, status); err != nil {
+			messages = append(messages, err.Error())
+		}
+	}
+	if result.SourceStatus != nil {
+		description := "Deployed"
+		if outcome != nil {
+			description = fmt.Sprintf("Failed: %s", outcome)
+		}
+		log.Printf("Marking %s on the source commit as %s", result.SourceStatus.GetContext(), status)
+		if _, err := state.createSourceStatus(ctx, &github.RepoStatus{
+			State:       &status,
+			TargetURL:   result.SourceStatus.TargetURL,
+			Description: refStr(truncate(description, 140)),
+			Context:     result.SourceStatus.Context,
+		}); err != nil {
+			messages = append(messages, err.Error())
+		}
+	}
+	if len(messages) > 0 {
+		return errors.New(strings.Join(messages, "; "))
+	}
+	return nil
+}
+
+// sourceStatus posts a pending commit status on the source commit, linking to the PR or the synced commit
+func (state State) sourceStatus(result Result) (*github.RepoStatus, error) {
+	Global := state.Global
+	target := state.commitURL(result.Commit.Hash)
+	if result.PR != nil {
+		target = result.PR.URL
+	}
+	description := fmt.Sprintf("Synced to %s/%s@%s", state.orgName, state.repoName, result.Commit.Hash.String()[:7])
+	if Global.WaitForTags.Glob != nil {
+		description = fmt.Sprintf("Waiting for %s/%s@%s to be deployed", state.orgName, state.repoName, result.Commit.Hash.String()[:7])
+	}
+	log.Printf("Marking %s on the source commit %s as pending", Global.SourceStatus, Global.SourceCommit)
+	return state.createSourceStatus(context.Background(), &github.RepoStatus{
+		State:       refStr("pending"),
+		TargetURL:   &target,
+		Description: &description,
+		Context:     &Global.SourceStatus,
+	})
+}
+
+func (state State) createSourceStatus(ctx context.Context, status *github.RepoStatus) (*github.RepoStatus, error) {
+	owner, repo, err := githubutil.ParseGitHubRepo(state.Global.SourceRepo)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing source repo url")
+	}
+	created, _, err := state.client.Repositories.CreateStatus(ctx, owner, repo, state.Global.SourceCommit, status)
+	return created, errors.Wrapf(err, "setting status %s", status.GetState())
+}
+
+// truncate shortens s to at most n characters, cutting on a rune boundary
+func truncate(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n-3]) + "..."
+	}
+	return s
+}
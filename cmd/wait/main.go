@@ -16,8 +16,13 @@ func main() {
 	if len(os.Args) <= 3 {
 		log.Fatal("Usage: wait [./repo] [commit hash] [gke_myproject_*]")
 	}
+	Global := Config{}
 	repo, err := git.PlainOpen(os.Args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
 	commit := plumbing.NewHash(os.Args[2])
+	logProvenance(repo, commit)
 	Global.WaitForTags = GlobValue{Glob: glob.MustCompile(os.Args[3])}
 
 	// Execute wait
@@ -28,3 +33,22 @@ func main() {
 		os.Exit(0)
 	}
 }
+
+// logProvenance prints where the commit was synced from, if it was created by gitops-sync
+func logProvenance(repo *git.Repository, hash plumbing.Hash) {
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return
+	}
+	trailers := gitlogic.ParseTrailers(commit.Message)
+	if trailers.Get(gitlogic.TrailerSyncedBy) == "" {
+		return
+	}
+	log.Printf("Commit %s was synced from:", hash)
+	for _, t := range trailers {
+		log.Printf("- %s: %s", t.Key, t.Value)
+	}
+	if provenance, err := gitlogic.ReadNote(repo, hash); err == nil {
+		log.Printf("- %d files, synced at %s by %s", len(provenance.Files), provenance.SyncedAt, FirstStr(provenance.Builder.User, provenance.Builder.Tool))
+	}
+}
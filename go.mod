@@ -10,6 +10,8 @@ require (
 	github.com/jnovack/flag v1.16.0
 	github.com/koron-go/prefixw v1.0.0
 	github.com/pkg/errors v0.9.1
+	github.com/sergi/go-diff v1.1.0
 	github.com/stretchr/testify v1.4.0
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 	golang.org/x/sync v0.1.0
 )
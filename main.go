@@ -7,7 +7,6 @@ import (
 
 	"github.com/Q42Philips/gitops-sync/cmd/sync"
 	"github.com/Q42Philips/gitops-sync/pkg/config"
-	. "github.com/Q42Philips/gitops-sync/pkg/config"
 	"github.com/Q42Philips/gitops-sync/pkg/gitlogic"
 )
 
@@ -23,25 +22,52 @@ func init() {
 }
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		gc()
+		return
+	}
+
 	Global := config.Config{}
 	Global.Init()
 	Global.ParseAndValidate()
+	Global.Version = version
 
 	result, err := sync.Main(Global)
-	if err != nil {
-		os.Exit(1)
-	} else {
+	if err == nil {
 		os.Stdout.Write([]byte(result.Commit.String() + "\n"))
 	}
 
-	if Global.WaitForTags.Glob != nil {
+	if err == nil && Global.WaitForTags.Glob != nil {
 		log.Printf("Waiting for tags (%q) to include synced commit", Global.WaitForTags.String())
 		err = gitlogic.WaitForTags(context.Background(), Global, result.Commit.Hash, result.Repository)
 		if err != nil {
 			log.Printf("Error waiting for tags: %s", err)
-			os.Exit(1)
-		} else {
-			os.Exit(0)
 		}
 	}
+
+	if reportErr := sync.Report(Global, result, err); reportErr != nil {
+		log.Printf("Error reporting the outcome: %s", reportErr)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// gc deletes stale head branches
+func gc() {
+	Global := config.Config{}
+	Global.Init()
+	Global.ParseAndValidate()
+	Global.Version = version
+
+	deleted, err := sync.GC(Global)
+	if err != nil {
+		log.Printf("Error collecting branches: %s", err)
+		os.Exit(1)
+	}
+	for _, branch := range deleted {
+		os.Stdout.Write([]byte(branch + "\n"))
+	}
 }
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http"
 
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/google/go-github/v33/github"
 )
@@ -26,6 +27,28 @@ func (c *Config) GetClientAuth() (hubClient *github.Client, gitAuth githttp.Auth
 	return hubClient, gitAuth, nil
 }
 
+// GetGitAuth returns the authentication for git over HTTP(S): that of the GitHub client, or the -forge-token for other forges.
+// It is nil for output repositories that are not cloned over HTTP(S), leaving ssh to the ssh agent and other transports
+// unauthenticated, and with -forge git without -forge-token.
+func (c *Config) GetGitAuth() (gitAuth githttp.AuthMethod, err error) {
+	if FirstStr(c.Forge, ForgeGitHub) == ForgeGitHub {
+		_, gitAuth, err = c.GetClientAuth()
+		return gitAuth, err
+	}
+	if c.ForgeToken == "" {
+		if c.Forge == ForgeGit {
+			return nil, nil
+		}
+		return nil, errors.New("no authentication provided, set -forge-token")
+	}
+	if endpoint, err := transport.NewEndpoint(c.OutputRepoURL); err != nil || (endpoint.Protocol != "http" && endpoint.Protocol != "https") {
+		return nil, nil
+	}
+	gitAuth = &githttp.BasicAuth{Username: FirstStr(c.ForgeUsername, "gitops-sync"), Password: c.ForgeToken}
+	log.Println(gitAuth.String())
+	return gitAuth, nil
+}
+
 var _ githttp.AuthMethod = &BasicAuthWrapper{}
 
 type BasicAuthWrapper struct {
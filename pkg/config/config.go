@@ -1,11 +1,14 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/Q42Philips/gitops-sync/pkg/giturl"
 	"github.com/jnovack/flag"
 )
 
@@ -19,15 +22,63 @@ func (c *Config) Init() {
 	flag.StringVar(&c.OutputHead, "output-head", "", "reference to write to & create a PR from into base; default = generated")
 	flag.StringVar(&c.BasePR, "pr", "", "whether to create a PR, and if set, which branch to set as PR base")
 	flag.StringVar(&c.BaseMerge, "merge", "", "whether to merge straight away, which branch to set as merge base")
-	flag.StringVar(&c.PrBody, "pr-body", "Sync", "Body of PR")
+	flag.BoolVar(&c.DeleteHead, "delete-head-after-merge", false, "Delete the head branch after merging it with -merge, or once -wait-for-pr-merge sees the PR merged")
+	flag.BoolVar(&c.Direct, "direct", false, "Commit on top of the merge branch (or the base) and push straight to it, without pushing a head branch")
+	flag.StringVar(&c.MergeMode, "merge-mode", MergeModeMerge, "How to update the merge branch: ff (fast-forward if possible, otherwise squash), squash (single-parent commit) or merge (merge commit)")
+	flag.StringVar(&c.MergeStrategy, "merge-strategy", MergeStrategyTheirs, "How to merge: theirs (overwrite the output path with the input, keep everything else of the merge branch), ours-outside-path (also merge the changes of the head outside the output path, keeping the merge branch version of files changed on both) or three-way (merge changes of both sides to the output path, fail on conflicts)")
+	flag.StringVar(&c.PrRepoURL, "pr-repo", "", "Repository to open the PR in, when -output-repo is a fork of it (defaults to -output-repo)")
+	flag.StringVar(&c.PrBody, "pr-body", "Sync", "Body of PR, a Go text/template with the source (.SourceRepo, .SourceCommit, ...) and changes (.Files, .Directories, .Diff)")
+	flag.StringVar(&c.PrBodyFile, "pr-body-file", "", "File with the template of the PR body, instead of -pr-body")
+	flag.IntVar(&c.PrBodyMaxDiff, "pr-body-max-diff", 20000, "Truncate .Diff in the PR body template to this many bytes")
 	flag.StringVar(&c.PrTitle, "pr-title", "Sync", "Title of PR; defaults to commit message")
+	flag.BoolVar(&c.PrDraft, "pr-draft", true, "Create the PR as draft; with false an existing draft PR is marked ready for review")
+	flag.StringVar(&c.PrAutoMerge, "pr-auto-merge", "", "Enable auto-merge on the PR with this merge method: squash, merge or rebase")
+	flag.BoolVar(&c.Supersede, "supersede", false, "Close the other open sync PRs into the same PR base and output path after creating a PR")
+	flag.BoolVar(&c.SupersedeDeleteHead, "supersede-delete-head", false, "Delete the head branches of the PRs closed by -supersede")
+	flag.BoolVar(&c.PrCommentChanges, "pr-comment-changes", false, "Comment the files changed since the previous sync on an existing PR")
+	flag.Var(&c.PrLabels, "pr-labels", "Comma separated labels to add to the PR")
+	flag.Var(&c.PrReviewers, "pr-reviewers", "Comma separated users to request a review of the PR from")
+	flag.Var(&c.PrTeamReviewers, "pr-team-reviewers", "Comma separated teams (slugs) to request a review of the PR from")
+	flag.Var(&c.PrAssignees, "pr-assignees", "Comma separated users to assign the PR to")
+	flag.StringVar(&c.PrMilestone, "pr-milestone", "", "Milestone (number or title) to add the PR to")
+	flag.StringVar(&c.Tag, "tag", "", "Tag the synced commit (the merge commit with -merge); a template like deploy/prod/{{.Time}} or deploy/{{.Branch}}/{{.ShortSourceCommit}}")
+	flag.StringVar(&c.TagMessage, "tag-message", "", "Message (template) of an annotated tag; tags are annotated when set or when signing (default: the tag name)")
+	flag.BoolVar(&c.ForceTag, "force-tag", false, "Move the tag if it already exists on another commit")
 	flag.Var(&c.CommitTime, "commit-timestamp", "Time of the commit; for example $CI_COMMIT_TIMESTAMP of the original commit (default: now)")
 
+	// Identity of the commits, defaults to the authenticated user
+	flag.StringVar(&c.AuthorName, "author-name", "", "Name of the commit author (default: the authenticated user)")
+	flag.StringVar(&c.AuthorEmail, "author-email", "", "Email of the commit author (default: the authenticated user)")
+	flag.StringVar(&c.CommitterName, "committer-name", "", "Name of the committer (default: the authenticated user)")
+	flag.StringVar(&c.CommitterEmail, "committer-email", "", "Email of the committer (default: the authenticated user)")
+	flag.BoolVar(&c.AuthorFromSource, "author-from-source", false, "Use the author of the source commit ($CI_COMMIT_AUTHOR or $GITHUB_ACTOR) as commit author")
+
+	// Source provenance, added as trailers to the sync commits
+	flag.StringVar(&c.SourceRepo, "source-repo", "", "URL of the source repository; defaults to $CI_PROJECT_URL or $GITHUB_SERVER_URL/$GITHUB_REPOSITORY")
+	flag.StringVar(&c.SourceCommit, "source-commit", "", "Source commit hash; defaults to $CI_COMMIT_SHA or $GITHUB_SHA")
+	flag.StringVar(&c.SourceRef, "source-ref", "", "Source reference; defaults to $CI_COMMIT_REF_NAME or $GITHUB_REF")
+	flag.StringVar(&c.PipelineURL, "pipeline-url", "", "URL of the pipeline doing the sync; defaults to $CI_PIPELINE_URL or the GitHub Actions run")
+
+	// Signing
+	flag.StringVar(&c.SigningKey, "signing-key", "", "File with the key to sign commits with: an armored OpenPGP private key, or an SSH private key when using -signing-format=ssh")
+	flag.StringVar(&c.SigningKeyPassphrase, "signing-key-passphrase", "", "Passphrase of the signing key")
+	flag.StringVar(&c.SigningFormat, "signing-format", "openpgp", "Signature format: openpgp or ssh")
+
 	flag.BoolVar(&c.DryRun, "dry-run", false, "Do not push, merge, nor PR")
+	flag.IntVar(&c.PushRetries, "push-retries", 3, "How often to redo the sync on top of the latest base when a push is rejected because of a parallel sync")
 	flag.IntVar(&c.Depth, "depth", 0, "Set the depth to do a shallow clone. Use with caution, go-git pushes can fail for shallow branches.")
 
 	// Wait for tags
 	flag.Var(&c.WaitForTags, "wait-for-tags", "Wait for certain tags to update (glob patterns supported): example flux-sync or gke_myproject_*")
+	flag.BoolVar(&c.WaitForPRMerge, "wait-for-pr-merge", false, "Wait until the PR is merged and wait for the tags to include the merge commit on the PR base")
+	flag.DurationVar(&c.PRMergeTimeout, "pr-merge-timeout", time.Hour, "How long to wait for the PR to be merged")
+	flag.StringVar(&c.SourceStatus, "source-status", "", "Post a commit status with this context (for example gitops/production) on -source-commit in -source-repo, linking to the synced commit or PR")
+	flag.StringVar(&c.DeploymentEnvironment, "deployment-environment", "", "Register a GitHub Deployment of the synced commit to this environment, successful once the tags include it")
+
+	// Garbage collection of head branches (gc subcommand)
+	c.GCBranches.Set("auto/sync/*")
+	flag.Var(&c.GCBranches, "gc-branches", "gc: remote branches to consider for deletion (glob patterns supported)")
+	flag.DurationVar(&c.GCMaxAge, "gc-max-age", 7*24*time.Hour, "gc: only delete branches whose last commit is older than this")
 
 	// Authentication
 	// Either use
@@ -36,8 +87,54 @@ func (c *Config) Init() {
 	flag.StringVar(&c.AuthOtp, "github-otp", "", "GitHub OTP to use for basic auth")
 	// Or use
 	flag.StringVar(&c.AuthToken, "github-token", "", "GitHub token, authorize using env $GITHUB_TOKEN (convention)")
+
+	// Other forges than GitHub
+	flag.StringVar(&c.Forge, "forge", ForgeGitHub, "Forge hosting the output repository: github, bitbucket (Server/Data Center), gitea, azure (DevOps) or git (any git server or local repository, without pull requests)")
+	flag.StringVar(&c.ForgeURL, "forge-url", "", "Web URL of the forge including any context path, when it cannot be derived from -output-repo (for example with ssh)")
+	flag.StringVar(&c.ForgeUsername, "forge-username", "", "Username for git over HTTP with -forge-token (default: gitops-sync)")
+	flag.StringVar(&c.ForgeToken, "forge-token", "", "Access token for the forge API and git over HTTP (a personal access token for Azure DevOps, or a password with -forge git)")
 }
 
+// Merge modes for -merge-mode
+const (
+	MergeModeFastForward = "ff"
+	MergeModeSquash      = "squash"
+	MergeModeMerge       = "merge"
+)
+
+// MergeModes lists all valid merge modes
+var MergeModes = []string{MergeModeFastForward, MergeModeSquash, MergeModeMerge}
+
+// Merge strategies for -merge-strategy
+const (
+	// MergeStrategyTheirs overwrites the output path with the input, everything else is kept as on the merge branch
+	MergeStrategyTheirs = "theirs"
+	// MergeStrategyOursOutsidePath takes the output path of the head and merges the changes of the head outside the
+	// output path as well, keeping the merge branch version of files that both changed
+	MergeStrategyOursOutsidePath = "ours-outside-path"
+	// MergeStrategyThreeWay merges the changes of both sides in the output path, failing on conflicts
+	MergeStrategyThreeWay = "three-way"
+)
+
+// MergeStrategies lists all valid merge strategies
+var MergeStrategies = []string{MergeStrategyTheirs, MergeStrategyOursOutsidePath, MergeStrategyThreeWay}
+
+// AutoMergeMethods lists the merge methods of -pr-auto-merge
+var AutoMergeMethods = []string{"squash", "merge", "rebase"}
+
+// Forges for -forge
+const (
+	ForgeGitHub    = "github"
+	ForgeBitbucket = "bitbucket"
+	ForgeGitea     = "gitea"
+	ForgeAzure     = "azure"
+	// ForgeGit uses plain git only, without forge API
+	ForgeGit = "git"
+)
+
+// Forges lists all supported forges
+var Forges = []string{ForgeGitHub, ForgeBitbucket, ForgeGitea, ForgeAzure, ForgeGit}
+
 type Config struct {
 	CommitMsg      string
 	InputPath      string
@@ -47,26 +144,102 @@ type Config struct {
 	OutputHead     string
 	BasePR         string
 	BaseMerge      string
+	Direct         bool
+	DeleteHead     bool
+	MergeMode      string
+	MergeStrategy  string
 	PrBody         string
 	PrTitle        string
+	Tag            string
+	TagMessage     string
+	ForceTag       bool
+
+	PrRepoURL        string
+	PrDraft          bool
+	PrCommentChanges bool
+	PrAutoMerge      string
+	PrBodyFile       string
+	PrBodyMaxDiff    int
+	PrLabels         ListValue
+	PrReviewers      ListValue
+	PrTeamReviewers  ListValue
+	PrAssignees      ListValue
+	PrMilestone      string
+
+	Supersede           bool
+	SupersedeDeleteHead bool
+
 	// Allow a configured commit time to allow aligning GitOps commits to the original repo commit
 	CommitTime TimeValue
 
-	DryRun bool
-	Depth  int
+	AuthorName       string
+	AuthorEmail      string
+	CommitterName    string
+	CommitterEmail   string
+	AuthorFromSource bool
+
+	SourceRepo   string
+	SourceCommit string
+	SourceRef    string
+	PipelineURL  string
 
-	WaitForTags GlobValue
+	SigningKey           string
+	SigningKeyPassphrase string
+	SigningFormat        string
+
+	// Version of gitops-sync, set by main
+	Version string
+
+	DryRun      bool
+	Depth       int
+	PushRetries int
+
+	WaitForTags    GlobValue
+	WaitForPRMerge bool
+	PRMergeTimeout time.Duration
+
+	DeploymentEnvironment string
+	SourceStatus          string
+
+	GCBranches GlobValue
+	GCMaxAge   time.Duration
 
 	AuthUsername string
 	AuthPassword string
 	AuthOtp      string
 	AuthToken    string
+
+	Forge         string
+	ForgeURL      string
+	ForgeUsername string
+	ForgeToken    string
 }
 
 func (c *Config) ParseAndValidate() {
 	flag.Parse()
+	if err := c.Validate(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Validate checks the combination of flags and fills in the defaults
+func (c *Config) Validate() error {
 	if c.OutputRepoURL == "" {
-		log.Fatal("No output repository set")
+		return errors.New("No output repository set")
+	}
+	if err := c.validateChoices(); err != nil {
+		return err
+	}
+	if c.PrBodyMaxDiff < 0 {
+		return errors.New("-pr-body-max-diff cannot be negative")
+	}
+	if err := c.validateDeleteHead(); err != nil {
+		return err
+	}
+	if c.Direct {
+		if err := c.directTarget(); err != nil {
+			return err
+		}
 	}
 	if c.OutputHead == "" {
 		c.OutputHead = fmt.Sprintf("auto/sync/%s", time.Now().Format("20060102T150405Z"))
@@ -82,4 +255,130 @@ func (c *Config) ParseAndValidate() {
 		}
 		c.CommitMsg = fmt.Sprintf("Sync %s/%s", project, refName)
 	}
+	if time.Time(c.CommitTime).IsZero() {
+		c.CommitTime = TimeValue(time.Now())
+	}
+	c.sourceFromEnv()
+	if c.AuthorFromSource {
+		c.authorFromEnv()
+	}
+	return c.validateSourceStatus()
+}
+
+// validateSourceStatus checks that -source-status has a source commit on GitHub to post the status on
+func (c *Config) validateSourceStatus() error {
+	if c.SourceStatus == "" {
+		return nil
+	}
+	if c.SourceRepo == "" || c.SourceCommit == "" {
+		return errors.New("-source-status requires -source-repo and -source-commit")
+	}
+	if u, err := giturl.ParseRepoURL(c.SourceRepo); err != nil || u.Hostname() != "github.com" {
+		return fmt.Errorf("-source-status posts a GitHub commit status, but -source-repo %q is not on github.com", c.SourceRepo)
+	}
+	return nil
+}
+
+// validateChoices checks the flags that take one of a list of values
+func (c *Config) validateChoices() error {
+	for _, f := range []struct {
+		name    string
+		value   string
+		choices []string
+	}{
+		{"-merge-mode", c.MergeMode, MergeModes},
+		{"-merge-strategy", c.MergeStrategy, MergeStrategies},
+		{"-pr-auto-merge", c.PrAutoMerge, AutoMergeMethods},
+	} {
+		if f.value != "" && !contains(f.choices, f.value) {
+			return fmt.Errorf("invalid %s %q, use one of %s", f.name, f.value, f.choices)
+		}
+	}
+	return nil
+}
+
+// validateDeleteHead checks that -delete-head-after-merge has a merge to delete the head after
+func (c *Config) validateDeleteHead() error {
+	if !c.DeleteHead || c.BasePR == "" {
+		return nil
+	}
+	if c.BaseMerge != "" {
+		return errors.New("-delete-head-after-merge cannot be combined with both -merge and -pr, as the head would be deleted before opening the PR from it")
+	}
+	if !c.WaitForPRMerge && !(c.Forge == ForgeAzure && c.PrAutoMerge != "") {
+		return errors.New("-delete-head-after-merge with -pr needs -wait-for-pr-merge (or -pr-auto-merge on Azure DevOps) to see the PR merged")
+	}
+	return nil
+}
+
+// directTarget makes the sync commit on top of the merge branch (or the base) and push it there, without head branch
+func (c *Config) directTarget() error {
+	if c.BasePR != "" {
+		return errors.New("-direct cannot be combined with -pr, as there is no head branch to create a PR from")
+	}
+	target := FirstStr(c.BaseMerge, c.OutputBase)
+	if c.OutputHead != "" && c.OutputHead != target {
+		return fmt.Errorf("-direct pushes to %q, but -output-head is %q", target, c.OutputHead)
+	}
+	c.OutputBase, c.OutputHead, c.BaseMerge = target, target, ""
+	return nil
+}
+
+// authorFromEnv takes the author of the source commit from well-known CI variables (GitLab CI and GitHub Actions)
+func (c *Config) authorFromEnv() {
+	name, email := parseIdentity(os.Getenv("CI_COMMIT_AUTHOR"))
+	if name == "" && os.Getenv("GITHUB_ACTOR") != "" {
+		name = os.Getenv("GITHUB_ACTOR")
+		email = fmt.Sprintf("%s@users.noreply.github.com", name)
+	}
+	c.AuthorName = FirstStr(c.AuthorName, name)
+	c.AuthorEmail = FirstStr(c.AuthorEmail, email)
+}
+
+// parseIdentity splits "Name <email>"
+func parseIdentity(s string) (name, email string) {
+	start, end := strings.LastIndex(s, "<"), strings.LastIndex(s, ">")
+	if start < 0 || end < start {
+		return strings.TrimSpace(s), ""
+	}
+	return strings.TrimSpace(s[:start]), strings.TrimSpace(s[start+1 : end])
+}
+
+// sourceFromEnv fills the source provenance from well-known CI variables (GitLab CI and GitHub Actions)
+func (c *Config) sourceFromEnv() {
+	github := ""
+	if os.Getenv("GITHUB_REPOSITORY") != "" {
+		github = fmt.Sprintf("%s/%s", firstEnv("GITHUB_SERVER_URL", "https://github.com"), os.Getenv("GITHUB_REPOSITORY"))
+	}
+	githubRun := ""
+	if github != "" && os.Getenv("GITHUB_RUN_ID") != "" {
+		githubRun = fmt.Sprintf("%s/actions/runs/%s", github, os.Getenv("GITHUB_RUN_ID"))
+	}
+	c.SourceRepo = FirstStr(c.SourceRepo, os.Getenv("CI_PROJECT_URL"), github)
+	c.SourceCommit = FirstStr(c.SourceCommit, os.Getenv("CI_COMMIT_SHA"), os.Getenv("GITHUB_SHA"))
+	c.SourceRef = FirstStr(c.SourceRef, os.Getenv("CI_COMMIT_REF_NAME"), os.Getenv("GITHUB_REF"))
+	c.PipelineURL = FirstStr(c.PipelineURL, os.Getenv("CI_PIPELINE_URL"), githubRun)
+}
+
+func firstEnv(name string, def string) string {
+	return FirstStr(os.Getenv(name), def)
+}
+
+func contains(list []string, item string) bool {
+	for _, l := range list {
+		if l == item {
+			return true
+		}
+	}
+	return false
+}
+
+// FirstStr returns the first non-empty string
+func FirstStr(args ...string) string {
+	for _, a := range args {
+		if a != "" {
+			return a
+		}
+	}
+	return ""
 }
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorFromEnv(t *testing.T) {
+	os.Setenv("CI_COMMIT_AUTHOR", "Jane Doe <jane@example.com>")
+	defer os.Unsetenv("CI_COMMIT_AUTHOR")
+
+	c := Config{}
+	c.authorFromEnv()
+	assert.Equal(t, "Jane Doe", c.AuthorName)
+	assert.Equal(t, "jane@example.com", c.AuthorEmail)
+
+	// Flags take precedence
+	c = Config{AuthorEmail: "other@example.com"}
+	c.authorFromEnv()
+	assert.Equal(t, "Jane Doe", c.AuthorName)
+	assert.Equal(t, "other@example.com", c.AuthorEmail)
+}
+
+func TestDirectTarget(t *testing.T) {
+	c := Config{OutputBase: "develop", BaseMerge: "production"}
+	assert.NoError(t, c.directTarget())
+	assert.Equal(t, "production", c.OutputBase)
+	assert.Equal(t, "production", c.OutputHead)
+	assert.Equal(t, "", c.BaseMerge)
+
+	c = Config{OutputBase: "develop", BasePR: "production"}
+	assert.Error(t, c.directTarget())
+	c = Config{OutputBase: "develop", OutputHead: "feature"}
+	assert.Error(t, c.directTarget())
+}
+
+func TestValidateChoices(t *testing.T) {
+	assert.NoError(t, (&Config{}).validateChoices())
+	assert.NoError(t, (&Config{MergeStrategy: MergeStrategyThreeWay}).validateChoices())
+	assert.Error(t, (&Config{MergeStrategy: "ours"}).validateChoices())
+	assert.NoError(t, (&Config{MergeMode: MergeModeSquash}).validateChoices())
+	assert.Error(t, (&Config{MergeMode: "rebase"}).validateChoices())
+	assert.NoError(t, (&Config{PrAutoMerge: "rebase"}).validateChoices())
+	assert.Error(t, (&Config{PrAutoMerge: "fast-forward"}).validateChoices())
+}
+
+func TestValidateDeleteHead(t *testing.T) {
+	assert.NoError(t, (&Config{DeleteHead: true, BaseMerge: "production"}).validateDeleteHead())
+	assert.NoError(t, (&Config{DeleteHead: true, BasePR: "production", WaitForPRMerge: true}).validateDeleteHead())
+	assert.NoError(t, (&Config{DeleteHead: true, BasePR: "production", Forge: ForgeAzure, PrAutoMerge: "squash"}).validateDeleteHead())
+	assert.Error(t, (&Config{DeleteHead: true, BasePR: "production"}).validateDeleteHead())
+	assert.Error(t, (&Config{DeleteHead: true, BasePR: "production", Forge: ForgeGitea}).validateDeleteHead())
+	assert.Error(t, (&Config{DeleteHead: true, BasePR: "production", BaseMerge: "staging", WaitForPRMerge: true}).validateDeleteHead())
+}
+
+func TestValidateSourceStatus(t *testing.T) {
+	assert.NoError(t, (&Config{}).validateSourceStatus())
+	assert.NoError(t, (&Config{SourceStatus: "gitops", SourceRepo: "https://github.com/Q42Philips/app", SourceCommit: "abc123"}).validateSourceStatus())
+	assert.Error(t, (&Config{SourceStatus: "gitops", SourceRepo: "https://github.com/Q42Philips/app"}).validateSourceStatus())
+	assert.Error(t, (&Config{SourceStatus: "gitops", SourceRepo: "https://gitlab.com/q42/app", SourceCommit: "abc123"}).validateSourceStatus())
+}
+
+func TestListValue(t *testing.T) {
+	var list ListValue
+	assert.NoError(t, list.Set("a, b,,c"))
+	assert.NoError(t, list.Set("d"))
+	assert.Equal(t, ListValue{"a", "b", "c", "d"}, list)
+	assert.Equal(t, "a,b,c,d", list.String())
+}
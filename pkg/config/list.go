@@ -0,0 +1,20 @@
+package config
+
+import (
+	"strings"
+)
+
+// ListValue is a comma separated list; repeating the flag appends to the list
+type ListValue []string
+
+func (i *ListValue) Set(s string) error {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*i = append(*i, item)
+		}
+	}
+	return nil
+}
+
+func (i *ListValue) Get() interface{} { return []string(*i) }
+func (i *ListValue) String() string   { return strings.Join(*i, ",") }
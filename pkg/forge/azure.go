@@ -0,0 +1,202 @@
+package forge
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Azure is Azure DevOps Services or Server, using REST API 7.0 with a personal access token
+type Azure struct {
+	repo Repo
+	api  api
+	// identities is the API to look up reviewers, on a separate host for Azure DevOps Services
+	identities api
+	// userID of the token, set by CurrentUser
+	userID string
+}
+
+var _ Forge = &Azure{}
+
+const azureAPIVersion = "api-version=7.0"
+
+// azureMaxDescription is the maximum length of pull request descriptions
+const azureMaxDescription = 4000
+
+// azureMergeStrategies maps the GitHub merge methods of auto-merge to Azure DevOps merge strategies
+var azureMergeStrategies = map[string]string{
+	"merge":  "noFastForward",
+	"squash": "squash",
+	"rebase": "rebase",
+}
+
+// NewAzure returns the Azure DevOps API of repo
+func NewAzure(repo Repo, token string) *Azure {
+	auth := func(r *http.Request) { r.SetBasicAuth("", token) }
+	identitiesURL := repo.BaseURL
+	if u, err := url.Parse(repo.BaseURL); err == nil {
+		if u.Host == "dev.azure.com" {
+			u.Host = "vssps.dev.azure.com"
+		} else if strings.HasSuffix(u.Host, ".visualstudio.com") {
+			u.Host = strings.TrimSuffix(u.Host, ".visualstudio.com") + ".vssps.visualstudio.com"
+		}
+		identitiesURL = u.String()
+	}
+	return &Azure{
+		repo:       repo,
+		api:        api{baseURL: repo.BaseURL, auth: auth},
+		identities: api{baseURL: identitiesURL, auth: auth},
+	}
+}
+
+type azurePullRequest struct {
+	PullRequestID int64  `json:"pullRequestId"`
+	Title         string `json:"title"`
+	Description   string `json:"description"`
+	IsDraft       bool   `json:"isDraft"`
+}
+
+func (a *Azure) pullRequest(pr azurePullRequest) *PullRequest {
+	return &PullRequest{
+		ID:     pr.PullRequestID,
+		Number: int(pr.PullRequestID),
+		URL:    fmt.Sprintf("%s/%s/_git/%s/pullrequest/%d", a.repo.BaseURL, a.repo.Owner, a.repo.Name, pr.PullRequestID),
+		Title:  pr.Title,
+		Body:   pr.Description,
+		Draft:  pr.IsDraft,
+	}
+}
+
+func (a *Azure) pullRequestsPath() string {
+	return fmt.Sprintf("/%s/_apis/git/repositories/%s/pullrequests", url.PathEscape(a.repo.Owner), url.PathEscape(a.repo.Name))
+}
+
+func (a *Azure) CurrentUser(ctx context.Context) (*User, error) {
+	var data struct {
+		AuthenticatedUser struct {
+			ID                  string `json:"id"`
+			ProviderDisplayName string `json:"providerDisplayName"`
+			Properties          struct {
+				Account struct {
+					Value string `json:"$value"`
+				} `json:"Account"`
+			} `json:"properties"`
+		} `json:"authenticatedUser"`
+	}
+	if err := a.api.do(ctx, "GET", "/_apis/connectionData?connectOptions=none", nil, &data); err != nil {
+		return nil, err
+	}
+	user := data.AuthenticatedUser
+	a.userID = user.ID
+	return &User{Login: user.Properties.Account.Value, Name: user.ProviderDisplayName, Email: user.Properties.Account.Value}, nil
+}
+
+func (a *Azure) FindPullRequest(ctx context.Context, head, base string) (*PullRequest, error) {
+	query := url.Values{
+		"searchCriteria.sourceRefName": {"refs/heads/" + head},
+		"searchCriteria.status":        {"active"},
+	}
+	if base != "" {
+		query.Set("searchCriteria.targetRefName", "refs/heads/"+base)
+	}
+	var prs struct {
+		Value []azurePullRequest `json:"value"`
+	}
+	if err := a.api.do(ctx, "GET", a.pullRequestsPath()+"?"+query.Encode()+"&"+azureAPIVersion, nil, &prs); err != nil {
+		return nil, err
+	}
+	if len(prs.Value) == 0 {
+		return nil, nil
+	}
+	return a.pullRequest(prs.Value[0]), nil
+}
+
+// identity looks up the id of a user or group by name, e-mail address or account
+func (a *Azure) identity(ctx context.Context, name string) (string, error) {
+	query := url.Values{"searchFilter": {"General"}, "filterValue": {name}, "queryMembership": {"None"}}
+	var identities struct {
+		Value []struct {
+			ID string `json:"id"`
+		} `json:"value"`
+	}
+	if err := a.identities.do(ctx, "GET", "/_apis/identities?"+query.Encode()+"&"+azureAPIVersion, nil, &identities); err != nil {
+		return "", err
+	}
+	if len(identities.Value) == 0 {
+		return "", errors.Errorf("no identity %q", name)
+	}
+	return identities.Value[0].ID, nil
+}
+
+func (a *Azure) CreatePullRequest(ctx context.Context, pr NewPullRequest) (*PullRequest, error) {
+	type identity struct {
+		ID string `json:"id"`
+	}
+	request := struct {
+		SourceRefName string     `json:"sourceRefName"`
+		TargetRefName string     `json:"targetRefName"`
+		Title         string     `json:"title"`
+		Description   string     `json:"description"`
+		IsDraft       bool       `json:"isDraft"`
+		Reviewers     []identity `json:"reviewers"`
+	}{
+		SourceRefName: "refs/heads/" + pr.Head,
+		TargetRefName: "refs/heads/" + pr.Base,
+		Title:         pr.Title,
+		Description:   TruncateBody(pr.Body, azureMaxDescription),
+		IsDraft:       pr.Draft,
+		Reviewers:     []identity{},
+	}
+	for _, name := range pr.Reviewers {
+		id, err := a.identity(ctx, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reviewer %q", name)
+		}
+		request.Reviewers = append(request.Reviewers, identity{ID: id})
+	}
+	var created azurePullRequest
+	if err := a.api.do(ctx, "POST", a.pullRequestsPath()+"?"+azureAPIVersion, request, &created); err != nil {
+		return nil, errors.Wrap(err, "creating pull request")
+	}
+	result := a.pullRequest(created)
+	if pr.AutoMerge == "" {
+		return result, nil
+	}
+	return result, errors.Wrap(a.autoComplete(ctx, result, pr.AutoMerge, pr.DeleteHead), "enabling auto-complete")
+}
+
+// autoComplete completes pr with the merge strategy of method as soon as its policies pass
+func (a *Azure) autoComplete(ctx context.Context, pr *PullRequest, method string, deleteSourceBranch bool) error {
+	strategy, ok := azureMergeStrategies[method]
+	if !ok {
+		return errors.Errorf("unsupported merge method %q", method)
+	}
+	if a.userID == "" {
+		if _, err := a.CurrentUser(ctx); err != nil {
+			return err
+		}
+	}
+	request := map[string]interface{}{
+		"autoCompleteSetBy": map[string]interface{}{"id": a.userID},
+		"completionOptions": map[string]interface{}{"mergeStrategy": strategy, "deleteSourceBranch": deleteSourceBranch},
+	}
+	return a.api.do(ctx, "PATCH", fmt.Sprintf("%s/%d?%s", a.pullRequestsPath(), pr.ID, azureAPIVersion), request, nil)
+}
+
+func (a *Azure) UpdatePullRequest(ctx context.Context, pr *PullRequest, title, body string) error {
+	var updated azurePullRequest
+	request := map[string]interface{}{"title": title, "description": TruncateBody(body, azureMaxDescription)}
+	if err := a.api.do(ctx, "PATCH", fmt.Sprintf("%s/%d?%s", a.pullRequestsPath(), pr.ID, azureAPIVersion), request, &updated); err != nil {
+		return errors.Wrap(err, "updating pull request")
+	}
+	*pr = *a.pullRequest(updated)
+	return nil
+}
+
+func (a *Azure) CommitURL(hash string) string {
+	return fmt.Sprintf("%s/%s/_git/%s/commit/%s", a.repo.BaseURL, a.repo.Owner, a.repo.Name, hash)
+}
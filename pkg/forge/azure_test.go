@@ -0,0 +1,75 @@
+package forge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAzure(t *testing.T) {
+	var created, autoComplete map[string]interface{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/contoso/_apis/connectionData", func(w http.ResponseWriter, r *http.Request) {
+		_, password, _ := r.BasicAuth()
+		assert.Equal(t, "pat", password)
+		fmt.Fprint(w, `{"authenticatedUser": {"id": "user-1", "providerDisplayName": "GitOps", "properties": {"Account": {"$value": "gitops@contoso.com"}}}}`)
+	})
+	mux.HandleFunc("/contoso/_apis/identities", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "alice@contoso.com", r.URL.Query().Get("filterValue"))
+		fmt.Fprint(w, `{"value": [{"id": "alice-1"}]}`)
+	})
+	mux.HandleFunc("/contoso/Platform/_apis/git/repositories/gitops/pullrequests", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "7.0", r.URL.Query().Get("api-version"))
+		switch r.Method {
+		case http.MethodGet:
+			assert.Equal(t, "refs/heads/auto/sync/1", r.URL.Query().Get("searchCriteria.sourceRefName"))
+			assert.Equal(t, "refs/heads/production", r.URL.Query().Get("searchCriteria.targetRefName"))
+			fmt.Fprint(w, `{"value": [{"pullRequestId": 4, "title": "Sync", "isDraft": true}]}`)
+		case http.MethodPost:
+			json.NewDecoder(r.Body).Decode(&created)
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"pullRequestId": 5, "title": "Sync"}`)
+		}
+	})
+	mux.HandleFunc("/contoso/Platform/_apis/git/repositories/gitops/pullrequests/5", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPatch, r.Method)
+		json.NewDecoder(r.Body).Decode(&autoComplete)
+		fmt.Fprint(w, `{"pullRequestId": 5}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	ctx := context.Background()
+	a := NewAzure(Repo{BaseURL: server.URL + "/contoso", Owner: "Platform", Name: "gitops"}, "pat")
+
+	user, err := a.CurrentUser(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, &User{Login: "gitops@contoso.com", Name: "GitOps", Email: "gitops@contoso.com"}, user)
+
+	pr, err := a.FindPullRequest(ctx, "auto/sync/1", "production")
+	assert.NoError(t, err)
+	assert.Equal(t, &PullRequest{ID: 4, Number: 4, URL: server.URL + "/contoso/Platform/_git/gitops/pullrequest/4", Title: "Sync", Draft: true}, pr)
+
+	body := strings.Repeat("x", 5000)
+	pr, err = a.CreatePullRequest(ctx, NewPullRequest{
+		Head: "auto/sync/1", Base: "production", Title: "Sync", Body: body, Draft: true,
+		Reviewers: []string{"alice@contoso.com"}, AutoMerge: "squash", DeleteHead: true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), pr.ID)
+	assert.Equal(t, "refs/heads/auto/sync/1", created["sourceRefName"])
+	assert.Equal(t, "refs/heads/production", created["targetRefName"])
+	assert.Equal(t, true, created["isDraft"])
+	assert.Len(t, created["description"], azureMaxDescription)
+	assert.Equal(t, []interface{}{map[string]interface{}{"id": "alice-1"}}, created["reviewers"])
+	assert.Equal(t, map[string]interface{}{"id": "user-1"}, autoComplete["autoCompleteSetBy"])
+	assert.Equal(t, map[string]interface{}{"mergeStrategy": "squash", "deleteSourceBranch": true}, autoComplete["completionOptions"])
+
+	// Azure DevOps Services looks up identities on another host
+	assert.Equal(t, "https://vssps.dev.azure.com/contoso", NewAzure(Repo{BaseURL: "https://dev.azure.com/contoso"}, "").identities.baseURL)
+}
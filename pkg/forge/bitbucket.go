@@ -0,0 +1,165 @@
+package forge
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Bitbucket is Bitbucket Server / Data Center, using REST API 1.0 with an HTTP access token
+type Bitbucket struct {
+	repo Repo
+	api  api
+}
+
+var _ Forge = &Bitbucket{}
+
+// NewBitbucket returns the Bitbucket API of repo
+func NewBitbucket(repo Repo, token string) *Bitbucket {
+	return &Bitbucket{repo: repo, api: api{
+		baseURL: repo.BaseURL + "/rest/api/1.0",
+		auth:    func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) },
+	}}
+}
+
+type bitbucketRef struct {
+	ID string `json:"id"`
+}
+
+type bitbucketPullRequest struct {
+	ID          int64        `json:"id"`
+	Version     int          `json:"version"`
+	Title       string       `json:"title"`
+	Description string       `json:"description"`
+	Draft       bool         `json:"draft"`
+	FromRef     bitbucketRef `json:"fromRef"`
+	ToRef       bitbucketRef `json:"toRef"`
+	Links       struct {
+		Self []struct {
+			Href string `json:"href"`
+		} `json:"self"`
+	} `json:"links"`
+}
+
+func (pr bitbucketPullRequest) pullRequest() *PullRequest {
+	result := &PullRequest{ID: pr.ID, Number: int(pr.ID), Title: pr.Title, Body: pr.Description, Draft: pr.Draft, Version: pr.Version}
+	if len(pr.Links.Self) > 0 {
+		result.URL = pr.Links.Self[0].Href
+	}
+	return result
+}
+
+func (b *Bitbucket) pullRequestsPath() string {
+	return fmt.Sprintf("/projects/%s/repos/%s/pull-requests", url.PathEscape(b.repo.Owner), url.PathEscape(b.repo.Name))
+}
+
+// CurrentUser looks up the user of the token, which Bitbucket tells through the whoami servlet
+func (b *Bitbucket) CurrentUser(ctx context.Context) (*User, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", b.repo.BaseURL+"/plugins/servlet/applinks/whoami", nil)
+	if err != nil {
+		return nil, err
+	}
+	b.api.auth(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	name, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 || len(name) == 0 {
+		return nil, errors.Errorf("looking up the user of the token: %s", resp.Status)
+	}
+
+	var user struct {
+		Slug         string `json:"slug"`
+		DisplayName  string `json:"displayName"`
+		EmailAddress string `json:"emailAddress"`
+	}
+	if err = b.api.do(ctx, "GET", "/users/"+url.PathEscape(strings.TrimSpace(string(name))), nil, &user); err != nil {
+		return nil, err
+	}
+	return &User{Login: user.Slug, Name: user.DisplayName, Email: user.EmailAddress}, nil
+}
+
+func (b *Bitbucket) FindPullRequest(ctx context.Context, head, base string) (*PullRequest, error) {
+	query := url.Values{
+		"state":     {"OPEN"},
+		"direction": {"OUTGOING"},
+		"at":        {"refs/heads/" + head},
+		"limit":     {"100"},
+	}
+	for start := "0"; ; {
+		query.Set("start", start)
+		var page struct {
+			Values        []bitbucketPullRequest `json:"values"`
+			IsLastPage    bool                   `json:"isLastPage"`
+			NextPageStart int                    `json:"nextPageStart"`
+		}
+		if err := b.api.do(ctx, "GET", b.pullRequestsPath()+"?"+query.Encode(), nil, &page); err != nil {
+			return nil, err
+		}
+		for _, pr := range page.Values {
+			if base == "" || pr.ToRef.ID == "refs/heads/"+base {
+				return pr.pullRequest(), nil
+			}
+		}
+		if page.IsLastPage {
+			return nil, nil
+		}
+		start = fmt.Sprint(page.NextPageStart)
+	}
+}
+
+func (b *Bitbucket) CreatePullRequest(ctx context.Context, pr NewPullRequest) (*PullRequest, error) {
+	type user struct {
+		Name string `json:"name"`
+	}
+	type reviewer struct {
+		User user `json:"user"`
+	}
+	request := struct {
+		Title       string       `json:"title"`
+		Description string       `json:"description"`
+		Draft       bool         `json:"draft"`
+		FromRef     bitbucketRef `json:"fromRef"`
+		ToRef       bitbucketRef `json:"toRef"`
+		Reviewers   []reviewer   `json:"reviewers"`
+	}{
+		Title:       pr.Title,
+		Description: pr.Body,
+		Draft:       pr.Draft,
+		FromRef:     bitbucketRef{ID: "refs/heads/" + pr.Head},
+		ToRef:       bitbucketRef{ID: "refs/heads/" + pr.Base},
+		Reviewers:   []reviewer{},
+	}
+	for _, name := range pr.Reviewers {
+		request.Reviewers = append(request.Reviewers, reviewer{User: user{Name: name}})
+	}
+	var created bitbucketPullRequest
+	if err := b.api.do(ctx, "POST", b.pullRequestsPath(), request, &created); err != nil {
+		return nil, errors.Wrap(err, "creating pull request")
+	}
+	return created.pullRequest(), nil
+}
+
+func (b *Bitbucket) UpdatePullRequest(ctx context.Context, pr *PullRequest, title, body string) error {
+	request := map[string]interface{}{"version": pr.Version, "title": title, "description": body}
+	var updated bitbucketPullRequest
+	if err := b.api.do(ctx, "PUT", fmt.Sprintf("%s/%d", b.pullRequestsPath(), pr.ID), request, &updated); err != nil {
+		return errors.Wrap(err, "updating pull request")
+	}
+	pr.Title, pr.Body, pr.Version = updated.Title, updated.Description, updated.Version
+	return nil
+}
+
+func (b *Bitbucket) CommitURL(hash string) string {
+	return fmt.Sprintf("%s/projects/%s/repos/%s/commits/%s", b.repo.BaseURL, b.repo.Owner, b.repo.Name, hash)
+}
@@ -0,0 +1,71 @@
+package forge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBitbucket(t *testing.T) {
+	var created, updated map[string]interface{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bb/plugins/servlet/applinks/whoami", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		fmt.Fprint(w, "gitops-bot")
+	})
+	mux.HandleFunc("/bb/rest/api/1.0/users/gitops-bot", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"slug": "gitops-bot", "displayName": "GitOps", "emailAddress": "gitops@example.com"}`)
+	})
+	mux.HandleFunc("/bb/rest/api/1.0/projects/OPS/repos/gitops/pull-requests", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			assert.Equal(t, "refs/heads/auto/sync/1", r.URL.Query().Get("at"))
+			if r.URL.Query().Get("start") == "0" {
+				fmt.Fprint(w, `{"values": [{"id": 3, "toRef": {"id": "refs/heads/staging"}}], "isLastPage": false, "nextPageStart": 1}`)
+				return
+			}
+			fmt.Fprint(w, `{"values": [{"id": 4, "version": 2, "title": "Sync", "toRef": {"id": "refs/heads/production"}, "links": {"self": [{"href": "https://bb/pr/4"}]}}], "isLastPage": true}`)
+		case http.MethodPost:
+			json.NewDecoder(r.Body).Decode(&created)
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"id": 5, "version": 0, "title": "Sync", "draft": true, "links": {"self": [{"href": "https://bb/pr/5"}]}}`)
+		}
+	})
+	mux.HandleFunc("/bb/rest/api/1.0/projects/OPS/repos/gitops/pull-requests/4", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		json.NewDecoder(r.Body).Decode(&updated)
+		fmt.Fprint(w, `{"id": 4, "version": 3, "title": "New", "description": "body"}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	ctx := context.Background()
+	b := NewBitbucket(Repo{BaseURL: server.URL + "/bb", Owner: "OPS", Name: "gitops"}, "secret")
+
+	user, err := b.CurrentUser(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, &User{Login: "gitops-bot", Name: "GitOps", Email: "gitops@example.com"}, user)
+
+	pr, err := b.FindPullRequest(ctx, "auto/sync/1", "production")
+	assert.NoError(t, err)
+	assert.Equal(t, &PullRequest{ID: 4, Number: 4, URL: "https://bb/pr/4", Title: "Sync", Version: 2}, pr)
+
+	err = b.UpdatePullRequest(ctx, pr, "New", "body")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"version": float64(2), "title": "New", "description": "body"}, updated)
+	assert.Equal(t, 3, pr.Version)
+
+	pr, err = b.CreatePullRequest(ctx, NewPullRequest{Head: "auto/sync/1", Base: "production", Title: "Sync", Draft: true, Reviewers: []string{"alice"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://bb/pr/5", pr.URL)
+	assert.Equal(t, map[string]interface{}{"id": "refs/heads/auto/sync/1"}, created["fromRef"])
+	assert.Equal(t, map[string]interface{}{"id": "refs/heads/production"}, created["toRef"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"user": map[string]interface{}{"name": "alice"}}}, created["reviewers"])
+	assert.Equal(t, true, created["draft"])
+
+	assert.Equal(t, server.URL+"/bb/projects/OPS/repos/gitops/commits/abc", b.CommitURL("abc"))
+}
@@ -0,0 +1,134 @@
+package forge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	. "github.com/Q42Philips/gitops-sync/pkg/config"
+	"github.com/pkg/errors"
+)
+
+// Forge is the API of a git hosting service other than GitHub, which is used through go-github directly
+type Forge interface {
+	// CurrentUser returns the authenticated user
+	CurrentUser(ctx context.Context) (*User, error)
+	// FindPullRequest returns the open pull request from head into base (any base if empty), nil if there is none
+	FindPullRequest(ctx context.Context, head, base string) (*PullRequest, error)
+	CreatePullRequest(ctx context.Context, pr NewPullRequest) (*PullRequest, error)
+	// UpdatePullRequest changes the title and body of pr
+	UpdatePullRequest(ctx context.Context, pr *PullRequest, title, body string) error
+	// CommitURL is the web page of the commit
+	CommitURL(hash string) string
+}
+
+// User is an account on a forge
+type User struct {
+	Login string
+	Name  string
+	Email string
+}
+
+// PullRequest is a pull request on a forge
+type PullRequest struct {
+	// ID identifies the pull request in the API, Number in the web interface. These differ on some forges.
+	ID     int64
+	Number int
+	URL    string
+	Title  string
+	Body   string
+	Draft  bool
+	// Version of the pull request for optimistic locking (Bitbucket)
+	Version int
+}
+
+// NewPullRequest describes a pull request to create from the Head into the Base branch
+type NewPullRequest struct {
+	Head      string
+	Base      string
+	Title     string
+	Body      string
+	Draft     bool
+	Reviewers []string
+	// AutoMerge merges the pull request with this method (squash, merge or rebase) once it can be, where supported
+	AutoMerge string
+	// DeleteHead deletes the head branch when auto-merging
+	DeleteHead bool
+}
+
+// New returns the forge of kind (one of config.Forges, except GitHub) for repo, authenticating with token
+func New(kind string, repo Repo, token string) (Forge, error) {
+	switch kind {
+	case ForgeBitbucket:
+		return NewBitbucket(repo, token), nil
+	case ForgeGitea:
+		return NewGitea(repo, token), nil
+	case ForgeAzure:
+		return NewAzure(repo, token), nil
+	}
+	return nil, errors.Errorf("unsupported forge %q, use one of %s", kind, Forges)
+}
+
+// MaxBodyLength is the maximum length in bytes of pull request bodies on the forge of kind, 0 if there is no limit
+func MaxBodyLength(kind string) int {
+	if kind == ForgeAzure {
+		return azureMaxDescription
+	}
+	return 0
+}
+
+// TruncateBody shortens body to at most n bytes, cutting on a rune boundary and noting the truncation
+func TruncateBody(body string, n int) string {
+	if len(body) <= n {
+		return body
+	}
+	const truncated = "\n\n(truncated)"
+	body = body[:n-len(truncated)]
+	return strings.ToValidUTF8(body, "") + truncated
+}
+
+// api does JSON requests against a REST API
+type api struct {
+	baseURL string
+	// auth sets the authentication header of requests
+	auth func(r *http.Request)
+}
+
+// do requests path relative to the base URL, sending in (if not nil) and decoding the response into out (if not nil)
+func (a api) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(a.baseURL, "/")+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	a.auth(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s %s", method, req.URL, resp.Status, bytes.TrimSpace(data))
+	}
+	if out != nil && len(data) > 0 {
+		return errors.Wrapf(json.Unmarshal(data, out), "decoding %s %s", method, req.URL)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package forge
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Gitea uses API v1 with an access token
+type Gitea struct {
+	repo Repo
+	api  api
+}
+
+var _ Forge = &Gitea{}
+
+// giteaDraftPrefix marks work in progress pull requests, Gitea's equivalent of drafts
+const giteaDraftPrefix = "WIP: "
+
+// NewGitea returns the Gitea API of repo
+func NewGitea(repo Repo, token string) *Gitea {
+	return &Gitea{repo: repo, api: api{
+		baseURL: repo.BaseURL + "/api/v1",
+		auth:    func(r *http.Request) { r.Header.Set("Authorization", "token "+token) },
+	}}
+}
+
+type giteaBranch struct {
+	Ref string `json:"ref"`
+}
+
+type giteaPullRequest struct {
+	ID      int64       `json:"id"`
+	Number  int         `json:"number"`
+	HTMLURL string      `json:"html_url"`
+	Title   string      `json:"title"`
+	Body    string      `json:"body"`
+	Head    giteaBranch `json:"head"`
+	Base    giteaBranch `json:"base"`
+}
+
+func (pr giteaPullRequest) pullRequest() *PullRequest {
+	return &PullRequest{
+		ID:     pr.ID,
+		Number: pr.Number,
+		URL:    pr.HTMLURL,
+		Title:  strings.TrimPrefix(pr.Title, giteaDraftPrefix),
+		Body:   pr.Body,
+		Draft:  strings.HasPrefix(pr.Title, giteaDraftPrefix),
+	}
+}
+
+func (g *Gitea) pullsPath() string {
+	return fmt.Sprintf("/repos/%s/%s/pulls", url.PathEscape(g.repo.Owner), url.PathEscape(g.repo.Name))
+}
+
+func (g *Gitea) CurrentUser(ctx context.Context) (*User, error) {
+	var user struct {
+		Login    string `json:"login"`
+		FullName string `json:"full_name"`
+		Email    string `json:"email"`
+	}
+	if err := g.api.do(ctx, "GET", "/user", nil, &user); err != nil {
+		return nil, err
+	}
+	return &User{Login: user.Login, Name: user.FullName, Email: user.Email}, nil
+}
+
+func (g *Gitea) FindPullRequest(ctx context.Context, head, base string) (*PullRequest, error) {
+	for page := 1; ; page++ {
+		var prs []giteaPullRequest
+		if err := g.api.do(ctx, "GET", fmt.Sprintf("%s?state=open&limit=50&page=%d", g.pullsPath(), page), nil, &prs); err != nil {
+			return nil, err
+		}
+		for _, pr := range prs {
+			if pr.Head.Ref == head && (base == "" || pr.Base.Ref == base) {
+				return pr.pullRequest(), nil
+			}
+		}
+		if len(prs) == 0 {
+			return nil, nil
+		}
+	}
+}
+
+func (g *Gitea) CreatePullRequest(ctx context.Context, pr NewPullRequest) (*PullRequest, error) {
+	title := pr.Title
+	if pr.Draft {
+		title = giteaDraftPrefix + title
+	}
+	var created giteaPullRequest
+	request := map[string]interface{}{"head": pr.Head, "base": pr.Base, "title": title, "body": pr.Body}
+	if err := g.api.do(ctx, "POST", g.pullsPath(), request, &created); err != nil {
+		return nil, errors.Wrap(err, "creating pull request")
+	}
+	if len(pr.Reviewers) > 0 {
+		path := fmt.Sprintf("%s/%d/requested_reviewers", g.pullsPath(), created.Number)
+		if err := g.api.do(ctx, "POST", path, map[string]interface{}{"reviewers": pr.Reviewers}, nil); err != nil {
+			return created.pullRequest(), errors.Wrap(err, "requesting reviewers")
+		}
+	}
+	return created.pullRequest(), nil
+}
+
+func (g *Gitea) UpdatePullRequest(ctx context.Context, pr *PullRequest, title, body string) error {
+	if pr.Draft {
+		title = giteaDraftPrefix + title
+	}
+	var updated giteaPullRequest
+	request := map[string]interface{}{"title": title, "body": body}
+	if err := g.api.do(ctx, "PATCH", fmt.Sprintf("%s/%d", g.pullsPath(), pr.Number), request, &updated); err != nil {
+		return errors.Wrap(err, "updating pull request")
+	}
+	*pr = *updated.pullRequest()
+	return nil
+}
+
+func (g *Gitea) CommitURL(hash string) string {
+	return fmt.Sprintf("%s/%s/%s/commit/%s", g.repo.BaseURL, g.repo.Owner, g.repo.Name, hash)
+}
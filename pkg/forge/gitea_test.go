@@ -0,0 +1,75 @@
+package forge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGitea(t *testing.T) {
+	var created, updated, reviewers map[string]interface{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/git/api/v1/user", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "token secret", r.Header.Get("Authorization"))
+		fmt.Fprint(w, `{"login": "gitops-bot", "full_name": "GitOps", "email": "gitops@example.com"}`)
+	})
+	mux.HandleFunc("/git/api/v1/repos/ops/gitops/pulls", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			switch r.URL.Query().Get("page") {
+			case "1":
+				fmt.Fprint(w, `[{"number": 3, "head": {"ref": "other"}, "base": {"ref": "production"}}]`)
+			case "2":
+				fmt.Fprint(w, `[{"number": 4, "html_url": "https://gitea/pulls/4", "title": "WIP: Sync", "head": {"ref": "auto/sync/1"}, "base": {"ref": "production"}}]`)
+			default:
+				fmt.Fprint(w, `[]`)
+			}
+		case http.MethodPost:
+			json.NewDecoder(r.Body).Decode(&created)
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"number": 5, "html_url": "https://gitea/pulls/5", "title": "Sync"}`)
+		}
+	})
+	mux.HandleFunc("/git/api/v1/repos/ops/gitops/pulls/4", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPatch, r.Method)
+		json.NewDecoder(r.Body).Decode(&updated)
+		fmt.Fprint(w, `{"number": 4, "html_url": "https://gitea/pulls/4", "title": "WIP: New", "body": "body"}`)
+	})
+	mux.HandleFunc("/git/api/v1/repos/ops/gitops/pulls/5/requested_reviewers", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&reviewers)
+		fmt.Fprint(w, `[]`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	ctx := context.Background()
+	g := NewGitea(Repo{BaseURL: server.URL + "/git", Owner: "ops", Name: "gitops"}, "secret")
+
+	user, err := g.CurrentUser(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, &User{Login: "gitops-bot", Name: "GitOps", Email: "gitops@example.com"}, user)
+
+	pr, err := g.FindPullRequest(ctx, "auto/sync/1", "production")
+	assert.NoError(t, err)
+	assert.Equal(t, &PullRequest{Number: 4, URL: "https://gitea/pulls/4", Title: "Sync", Draft: true}, pr)
+	pr, err = g.FindPullRequest(ctx, "auto/sync/1", "staging")
+	assert.NoError(t, err)
+	assert.Nil(t, pr)
+
+	// Drafts keep their work in progress prefix
+	err = g.UpdatePullRequest(ctx, &PullRequest{Number: 4, Draft: true}, "New", "body")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"title": "WIP: New", "body": "body"}, updated)
+
+	pr, err = g.CreatePullRequest(ctx, NewPullRequest{Head: "auto/sync/1", Base: "production", Title: "Sync", Body: "body", Reviewers: []string{"alice"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://gitea/pulls/5", pr.URL)
+	assert.Equal(t, map[string]interface{}{"head": "auto/sync/1", "base": "production", "title": "Sync", "body": "body"}, created)
+	assert.Equal(t, map[string]interface{}{"reviewers": []interface{}{"alice"}}, reviewers)
+
+	assert.Equal(t, server.URL+"/git/ops/gitops/commit/abc", g.CommitURL("abc"))
+}
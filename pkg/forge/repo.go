@@ -0,0 +1,68 @@
+package forge
+
+import (
+	"net/url"
+	"strings"
+
+	. "github.com/Q42Philips/gitops-sync/pkg/config"
+	"github.com/Q42Philips/gitops-sync/pkg/giturl"
+	"github.com/pkg/errors"
+)
+
+// Repo locates a repository on a forge
+type Repo struct {
+	// BaseURL is the web URL of the forge, including any context path, like https://git.example.com:8443/bitbucket
+	BaseURL string
+	// Owner is the Bitbucket project key, the Gitea user or organization or the Azure DevOps project
+	Owner string
+	Name  string
+}
+
+// ParseRepo locates the repository of a clone URL on a forge of kind. Bitbucket serves HTTP clones from
+// <base>/scm/<project>/<repo>.git, Gitea from <base>/<owner>/<repo>.git and Azure DevOps from
+// <base>/<project>/_git/<repo>, where the base is https://dev.azure.com/<organization> or a collection URL.
+// The base URL is derived from HTTP(S) URLs, for other protocols (like ssh) it is https://<host> unless baseURL overrides it.
+func ParseRepo(kind, cloneURL, baseURL string) (Repo, error) {
+	u, err := giturl.ParseRepoURL(cloneURL)
+	if err != nil {
+		return Repo{}, err
+	}
+	segments := append(strings.Split(u.Owner, "/"), u.Name)
+
+	// <base>/<owner>/<repo>, or <base>/scm/<project>/<repo> for Bitbucket, <base>/<project>/_git/<repo> for Azure DevOps
+	owner := len(segments) - 2
+	contextEnd := owner
+	if kind == ForgeBitbucket && owner > 0 && segments[owner-1] == "scm" {
+		contextEnd = owner - 1
+	}
+	if kind == ForgeAzure {
+		if u.Hostname() == "ssh.dev.azure.com" && len(segments) == 4 && segments[0] == "v3" {
+			// git@ssh.dev.azure.com:v3/<organization>/<project>/<repo>
+			u = giturl.RepoURL{Protocol: "https", Host: "dev.azure.com"}
+			segments = []string{segments[1], segments[2], "_git", segments[3]}
+		}
+		if owner < 1 || segments[owner] != "_git" {
+			return Repo{}, errors.Errorf("invalid %s repository url %q", kind, cloneURL)
+		}
+		segments = append(segments[:owner], segments[owner+1:]...)
+		owner, contextEnd = owner-1, owner-1
+	}
+	if u.Protocol == "file" || owner < 0 || segments[owner] == "" {
+		return Repo{}, errors.Errorf("invalid %s repository url %q", kind, cloneURL)
+	}
+	contextPath := segments[:contextEnd]
+
+	repo := Repo{BaseURL: baseURL, Owner: segments[owner], Name: segments[owner+1]}
+	if repo.BaseURL == "" {
+		base := url.URL{Scheme: u.Protocol, Host: u.Host}
+		if u.Protocol != "http" && u.Protocol != "https" {
+			base = url.URL{Scheme: "https", Host: u.Hostname()}
+		}
+		if len(contextPath) > 0 {
+			base.Path = "/" + strings.Join(contextPath, "/")
+		}
+		repo.BaseURL = base.String()
+	}
+	repo.BaseURL = strings.TrimSuffix(repo.BaseURL, "/")
+	return repo, nil
+}
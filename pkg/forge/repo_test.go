@@ -0,0 +1,42 @@
+package forge
+
+import (
+	"testing"
+
+	. "github.com/Q42Philips/gitops-sync/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRepo(t *testing.T) {
+	for _, c := range []struct {
+		kind, url, baseURL string
+		expected           Repo
+	}{
+		{ForgeBitbucket, "https://bitbucket.example.com/scm/ops/gitops.git", "", Repo{"https://bitbucket.example.com", "ops", "gitops"}},
+		{ForgeBitbucket, "https://git.example.com:8443/bitbucket/scm/OPS/gitops.git", "", Repo{"https://git.example.com:8443/bitbucket", "OPS", "gitops"}},
+		{ForgeBitbucket, "https://user@bitbucket.example.com/scm/~alice/gitops.git", "", Repo{"https://bitbucket.example.com", "~alice", "gitops"}},
+		{ForgeBitbucket, "ssh://git@bitbucket.example.com:7999/ops/gitops.git", "", Repo{"https://bitbucket.example.com", "ops", "gitops"}},
+		{ForgeBitbucket, "ssh://git@bitbucket.example.com:7999/ops/gitops.git", "http://bitbucket.example.com:7990/bb/", Repo{"http://bitbucket.example.com:7990/bb", "ops", "gitops"}},
+		{ForgeGitea, "https://gitea.example.com/ops/gitops.git", "", Repo{"https://gitea.example.com", "ops", "gitops"}},
+		{ForgeGitea, "http://gitea.example.com:3000/git/ops/config-git", "", Repo{"http://gitea.example.com:3000/git", "ops", "config-git"}},
+		{ForgeGitea, "ssh://git@gitea.example.com:2222/ops/gitops.git", "", Repo{"https://gitea.example.com", "ops", "gitops"}},
+		{ForgeGitea, "git@gitea.example.com:ops/gitops.git", "", Repo{"https://gitea.example.com", "ops", "gitops"}},
+		{ForgeAzure, "https://dev.azure.com/contoso/Platform/_git/gitops", "", Repo{"https://dev.azure.com/contoso", "Platform", "gitops"}},
+		{ForgeAzure, "https://contoso@dev.azure.com/contoso/Platform/_git/gitops", "", Repo{"https://dev.azure.com/contoso", "Platform", "gitops"}},
+		{ForgeAzure, "https://contoso.visualstudio.com/Platform/_git/gitops", "", Repo{"https://contoso.visualstudio.com", "Platform", "gitops"}},
+		{ForgeAzure, "https://tfs.example.com:8080/tfs/DefaultCollection/Platform/_git/gitops", "", Repo{"https://tfs.example.com:8080/tfs/DefaultCollection", "Platform", "gitops"}},
+		{ForgeAzure, "ssh://git@ssh.dev.azure.com/v3/contoso/Platform/gitops", "", Repo{"https://dev.azure.com/contoso", "Platform", "gitops"}},
+		{ForgeAzure, "git@ssh.dev.azure.com:v3/contoso/Platform/gitops", "", Repo{"https://dev.azure.com/contoso", "Platform", "gitops"}},
+	} {
+		repo, err := ParseRepo(c.kind, c.url, c.baseURL)
+		assert.NoError(t, err, c.url)
+		assert.Equal(t, c.expected, repo, c.url)
+	}
+
+	for _, u := range []string{"https://gitea.example.com/gitops.git", "https://gitea.example.com/ops/", "/srv/git/ops/gitops.git"} {
+		_, err := ParseRepo(ForgeGitea, u, "")
+		assert.Error(t, err, u)
+	}
+	_, err := ParseRepo(ForgeAzure, "https://dev.azure.com/contoso/Platform/gitops", "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,39 @@
+package githubutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/google/go-github/v33/github"
+)
+
+// GraphQL runs a query or mutation against the GraphQL API next to the REST API of client
+// (/graphql for github.com, /api/graphql for GitHub Enterprise), decoding the data into out
+func GraphQL(ctx context.Context, client *github.Client, query string, variables map[string]interface{}, out interface{}) error {
+	req, err := client.NewRequest("POST", "../graphql", map[string]interface{}{"query": query, "variables": variables})
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if _, err = client.Do(ctx, req, &resp); err != nil {
+		return err
+	}
+	if len(resp.Errors) > 0 {
+		messages := []string{}
+		for _, e := range resp.Errors {
+			messages = append(messages, e.Message)
+		}
+		return errors.New(strings.Join(messages, "; "))
+	}
+	if out == nil || len(resp.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(resp.Data, out)
+}
@@ -0,0 +1,44 @@
+package githubutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-github/v33/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGraphQL(t *testing.T) {
+	var request map[string]interface{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/graphql", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&request)
+		if request["variables"].(map[string]interface{})["id"] == "missing" {
+			fmt.Fprint(w, `{"errors": [{"message": "Could not resolve to a node"}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"data": {"node": {"number": 5}}}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(server.URL + "/api/v3/")
+
+	var out struct {
+		Node struct {
+			Number int `json:"number"`
+		} `json:"node"`
+	}
+	err := GraphQL(context.Background(), client, "query($id: ID!) { node(id: $id) { number } }", map[string]interface{}{"id": "PR_1"}, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, out.Node.Number)
+	assert.Equal(t, "query($id: ID!) { node(id: $id) { number } }", request["query"])
+
+	err = GraphQL(context.Background(), client, "query($id: ID!) { node(id: $id) { number } }", map[string]interface{}{"id": "missing"}, &out)
+	assert.EqualError(t, err, "Could not resolve to a node")
+}
@@ -1,19 +1,20 @@
 package githubutil
 
 import (
-	"errors"
-	"net/url"
 	"strings"
+
+	"github.com/Q42Philips/gitops-sync/pkg/giturl"
+	"github.com/pkg/errors"
 )
 
+// ParseGitHubRepo returns the organization (or user) and name of a GitHub repository URL in any git URL form
 func ParseGitHubRepo(u string) (org, repo string, err error) {
-	p, err := url.Parse(u)
+	parsed, err := giturl.ParseRepoURL(u)
 	if err != nil {
 		return "", "", err
 	}
-	pathSegments := strings.Split(strings.Trim(strings.TrimRight(p.Path, ".git"), "/"), "/")
-	if len(pathSegments) < 2 {
-		return "", "", errors.New("invalid github url")
+	if parsed.Protocol == "file" || parsed.Owner == "" || strings.Contains(parsed.Owner, "/") {
+		return "", "", errors.Errorf("invalid github url %q", u)
 	}
-	return pathSegments[0], pathSegments[1], nil
+	return parsed.Owner, parsed.Name, nil
 }
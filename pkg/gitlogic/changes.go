@@ -0,0 +1,158 @@
+package gitlogic
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/utils/merkletrie"
+)
+
+// File change statuses
+const (
+	StatusAdded    = "added"
+	StatusModified = "modified"
+	StatusDeleted  = "deleted"
+)
+
+// FileChange is a file changed by a sync
+type FileChange struct {
+	// Path relative to the repository root
+	Path   string
+	Status string
+}
+
+// Changes lists the files in outputPath changed from commit from (nil for an empty repository) to commit to, sorted by path
+func Changes(from, to *object.Commit, outputPath string) ([]FileChange, error) {
+	files, _, err := diffPath(from, to, outputPath)
+	return files, err
+}
+
+// ChangeSummary describes the changes of a sync, for example in the PR body
+type ChangeSummary struct {
+	Files       []FileChange
+	Directories []DirectoryChanges
+	// Diff is the unified diff of the files, truncated to the maximum size
+	Diff          string
+	DiffTruncated bool
+}
+
+// DirectoryChanges counts the changed files per directory
+type DirectoryChanges struct {
+	Path     string
+	Added    int
+	Modified int
+	Deleted  int
+}
+
+// Summarize describes the changes in outputPath from commit from (nil for an empty repository) to commit to,
+// truncating the diff to maxDiff bytes
+func Summarize(from, to *object.Commit, outputPath string, maxDiff int) (*ChangeSummary, error) {
+	files, changes, err := diffPath(from, to, outputPath)
+	if err != nil {
+		return nil, err
+	}
+	summary := &ChangeSummary{Files: files, Directories: []DirectoryChanges{}}
+
+	directories := make(map[string]*DirectoryChanges)
+	for _, file := range files {
+		dir := path.Dir(file.Path)
+		if directories[dir] == nil {
+			directories[dir] = &DirectoryChanges{Path: dir}
+		}
+		switch file.Status {
+		case StatusAdded:
+			directories[dir].Added++
+		case StatusModified:
+			directories[dir].Modified++
+		case StatusDeleted:
+			directories[dir].Deleted++
+		}
+	}
+	for _, dir := range directories {
+		summary.Directories = append(summary.Directories, *dir)
+	}
+	sort.Slice(summary.Directories, func(i, j int) bool { return summary.Directories[i].Path < summary.Directories[j].Path })
+
+	summary.Diff, summary.DiffTruncated, err = limitedDiff(changes, maxDiff)
+	if err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// limitedDiff renders the unified diff of the changes file by file, stopping once it exceeds maxDiff bytes
+func limitedDiff(changes object.Changes, maxDiff int) (diff string, truncated bool, err error) {
+	out := &strings.Builder{}
+	for _, change := range changes {
+		patch, err := change.Patch()
+		if err != nil {
+			return "", false, err
+		}
+		out.WriteString(patch.String())
+		if out.Len() > maxDiff {
+			// Cut at the last complete line
+			diff = out.String()[:maxDiff]
+			return diff[:strings.LastIndex(diff, "\n")+1], true, nil
+		}
+	}
+	return out.String(), false, nil
+}
+
+// diffPath returns the changed files in outputPath, sorted by path, and the corresponding changes
+func diffPath(from, to *object.Commit, outputPath string) ([]FileChange, object.Changes, error) {
+	fromTree := &object.Tree{}
+	if from != nil {
+		var err error
+		if fromTree, err = from.Tree(); err != nil {
+			return nil, nil, err
+		}
+	}
+	toTree, err := to.Tree()
+	if err != nil {
+		return nil, nil, err
+	}
+	changes, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	prefix := ""
+	if outputPath = path.Clean(outputPath); outputPath != "." {
+		prefix = outputPath + "/"
+	}
+	files := []FileChange{}
+	pathChanges := object.Changes{}
+	for _, change := range changes {
+		action, err := change.Action()
+		if err != nil {
+			return nil, nil, err
+		}
+		file := FileChange{Path: change.To.Name, Status: StatusModified}
+		switch action {
+		case merkletrie.Insert:
+			file.Status = StatusAdded
+		case merkletrie.Delete:
+			file.Path, file.Status = change.From.Name, StatusDeleted
+		}
+		if strings.HasPrefix(file.Path, prefix) {
+			files = append(files, file)
+			pathChanges = append(pathChanges, change)
+		}
+	}
+	sort.Sort(byPath{files, pathChanges})
+	return files, pathChanges, nil
+}
+
+type byPath struct {
+	files   []FileChange
+	changes object.Changes
+}
+
+func (b byPath) Len() int           { return len(b.files) }
+func (b byPath) Less(i, j int) bool { return b.files[i].Path < b.files[j].Path }
+func (b byPath) Swap(i, j int) {
+	b.files[i], b.files[j] = b.files[j], b.files[i]
+	b.changes[i], b.changes[j] = b.changes[j], b.changes[i]
+}
@@ -0,0 +1,89 @@
+package gitlogic
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChanges(t *testing.T) {
+	fs := memfs.New()
+	repo, err := git.Init(memory.NewStorage(), fs)
+	assert.NoError(t, err)
+	w, err := repo.Worktree()
+	assert.NoError(t, err)
+	signature := &object.Signature{Name: "F", Email: "f"}
+	writeFile(fs, "README.md", "readme")
+	writeFile(fs, "bases/app/deployment.yaml", "replicas: 1")
+	writeFile(fs, "bases/app/service.yaml", "port: 80")
+	assert.NoError(t, addAllFiles(w))
+	first, err := w.Commit("first", &git.CommitOptions{Author: signature})
+	assert.NoError(t, err)
+	writeFile(fs, "README.md", "updated")
+	writeFile(fs, "bases/app/deployment.yaml", "replicas: 2")
+	writeFile(fs, "bases/app/ingress.yaml", "host: example.com")
+	fs.Remove("bases/app/service.yaml")
+	assert.NoError(t, addAllFiles(w))
+	second, err := w.Commit("second", &git.CommitOptions{Author: signature})
+	assert.NoError(t, err)
+
+	firstCommit, _ := repo.CommitObject(first)
+	secondCommit, _ := repo.CommitObject(second)
+	changes, err := Changes(firstCommit, secondCommit, "bases/app")
+	assert.NoError(t, err)
+	assert.Equal(t, []FileChange{
+		{Path: "bases/app/deployment.yaml", Status: StatusModified},
+		{Path: "bases/app/ingress.yaml", Status: StatusAdded},
+		{Path: "bases/app/service.yaml", Status: StatusDeleted},
+	}, changes)
+
+	changes, err = Changes(nil, firstCommit, ".")
+	assert.NoError(t, err)
+	assert.Len(t, changes, 3)
+}
+
+func TestSummarize(t *testing.T) {
+	fs := memfs.New()
+	repo, err := git.Init(memory.NewStorage(), fs)
+	assert.NoError(t, err)
+	w, err := repo.Worktree()
+	assert.NoError(t, err)
+	signature := &object.Signature{Name: "F", Email: "f"}
+	writeFile(fs, "bases/app/deployment.yaml", "replicas: 1\n")
+	assert.NoError(t, addAllFiles(w))
+	first, err := w.Commit("first", &git.CommitOptions{Author: signature})
+	assert.NoError(t, err)
+	writeFile(fs, "bases/app/deployment.yaml", "replicas: 2\n")
+	writeFile(fs, "bases/app/config/env.yaml", "env: prod\n")
+	assert.NoError(t, addAllFiles(w))
+	second, err := w.Commit("second", &git.CommitOptions{Author: signature})
+	assert.NoError(t, err)
+
+	firstCommit, _ := repo.CommitObject(first)
+	secondCommit, _ := repo.CommitObject(second)
+	summary, err := Summarize(firstCommit, secondCommit, "bases/app", 10000)
+	assert.NoError(t, err)
+	assert.Len(t, summary.Files, 2)
+	assert.Equal(t, []DirectoryChanges{
+		{Path: "bases/app", Modified: 1},
+		{Path: "bases/app/config", Added: 1},
+	}, summary.Directories)
+	assert.Contains(t, summary.Diff, "-replicas: 1\n+replicas: 2\n")
+	assert.False(t, summary.DiffTruncated)
+
+	truncated, err := Summarize(firstCommit, secondCommit, "bases/app", 100)
+	assert.NoError(t, err)
+	assert.True(t, truncated.DiffTruncated)
+	assert.True(t, len(truncated.Diff) <= 100)
+	assert.True(t, strings.HasPrefix(summary.Diff, truncated.Diff))
+
+	empty, err := Summarize(firstCommit, secondCommit, "bases/app", 0)
+	assert.NoError(t, err)
+	assert.True(t, empty.DiffTruncated)
+	assert.Equal(t, "", empty.Diff)
+}
@@ -49,7 +49,7 @@ func RmRecursively(fs billy.Filesystem, path string) error {
 	return fs.Remove(path)
 }
 
-// Copy writes all files from fs1 to fs2
+// Copy writes all files from fs1 to fs2, keeping their permissions
 func Copy(fs1 billy.Filesystem, fs2 billy.Filesystem) error {
 	files, err := fs1.ReadDir(".")
 	if err != nil {
@@ -71,7 +71,7 @@ func Copy(fs1 billy.Filesystem, fs2 billy.Filesystem) error {
 		} else {
 			var f1 billy.File
 			var f2 billy.File
-			if f2, err = fs2.Create(f.Name()); err != nil {
+			if f2, err = fs2.OpenFile(f.Name(), os.O_RDWR|os.O_CREATE|os.O_TRUNC, f.Mode().Perm()); err != nil {
 				return err
 			}
 			defer f2.Close()
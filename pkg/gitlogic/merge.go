@@ -0,0 +1,343 @@
+package gitlogic
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	linediff "github.com/go-git/go-git/v5/utils/diff"
+	"github.com/pkg/errors"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// ConflictError reports the files that both sides changed in an incompatible way
+type ConflictError struct {
+	Conflicts []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("merge conflict in %d file(s):\n- %s", len(e.Conflicts), strings.Join(e.Conflicts, "\n- "))
+}
+
+// TreeFs returns the files of outputPath in commit as filesystem
+func TreeFs(commit *object.Commit, outputPath string) (billy.Filesystem, error) {
+	files, err := pathFiles(commit, outputPath)
+	if err != nil {
+		return nil, err
+	}
+	fs := memfs.New()
+	for name, f := range files {
+		if err = writeObjectFile(fs, name, f); err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+// MergePath does a three-way merge of outputPath of ours and theirs, using their merge base as common ancestor.
+// The merged files are returned as filesystem, or a *ConflictError if both sides changed the same lines.
+func MergePath(ours, theirs *object.Commit, outputPath string) (billy.Filesystem, error) {
+	forkFiles, ourFiles, theirFiles, err := sideFiles(ours, theirs, outputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, files := range []map[string]*object.File{forkFiles, ourFiles, theirFiles} {
+		for name := range files {
+			names[name] = true
+		}
+	}
+
+	fs := memfs.New()
+	conflicts := []string{}
+	for name := range names {
+		fork, o, t := forkFiles[name], ourFiles[name], theirFiles[name]
+		var result *object.File
+		switch {
+		case sameFile(o, t), sameFile(t, fork):
+			result = o
+		case sameFile(o, fork):
+			result = t
+		case o == nil:
+			conflicts = append(conflicts, fmt.Sprintf("%s (deleted by us, modified by them)", name))
+			continue
+		case t == nil:
+			conflicts = append(conflicts, fmt.Sprintf("%s (modified by us, deleted by them)", name))
+			continue
+		default:
+			merged, ok, err := mergeFiles(fork, o, t)
+			if err != nil {
+				return nil, errors.Wrapf(err, "merging %s", name)
+			}
+			if !ok {
+				conflicts = append(conflicts, fmt.Sprintf("%s (both modified)", name))
+				continue
+			}
+			// Keep the mode of the side that changed it
+			mode := t.Mode
+			if fork != nil && t.Mode == fork.Mode {
+				mode = o.Mode
+			}
+			if err = writeFileMode(fs, name, merged, mode); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if result == nil {
+			continue
+		}
+		if err = writeObjectFile(fs, name, result); err != nil {
+			return nil, err
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return nil, &ConflictError{Conflicts: conflicts}
+	}
+	return fs, nil
+}
+
+// MergeOutsidePath applies the changes of theirs outside outputPath to fs, the worktree of ours.
+// Files that ours changed as well keep the version of ours.
+func MergeOutsidePath(fs billy.Filesystem, ours, theirs *object.Commit, outputPath string) error {
+	if outputPath = path.Clean(outputPath); outputPath == "." {
+		return nil
+	}
+	forkFiles, ourFiles, theirFiles, err := sideFiles(ours, theirs, ".")
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, files := range []map[string]*object.File{forkFiles, theirFiles} {
+		for name := range files {
+			names[name] = true
+		}
+	}
+	for name := range names {
+		if name == outputPath || strings.HasPrefix(name, outputPath+"/") {
+			continue
+		}
+		fork, o, t := forkFiles[name], ourFiles[name], theirFiles[name]
+		if sameFile(t, fork) || sameFile(o, t) || !sameFile(o, fork) {
+			continue
+		}
+		if t == nil {
+			err = fs.Remove(name)
+		} else {
+			err = writeObjectFile(fs, name, t)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "merging %s", name)
+		}
+	}
+	return nil
+}
+
+// sideFiles lists the files below outputPath of the merge base of ours and theirs (none if unrelated), ours and theirs
+func sideFiles(ours, theirs *object.Commit, outputPath string) (forkFiles, ourFiles, theirFiles map[string]*object.File, err error) {
+	bases, err := ours.MergeBase(theirs)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "finding merge base")
+	}
+	if len(bases) > 0 {
+		if forkFiles, err = pathFiles(bases[0], outputPath); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if ourFiles, err = pathFiles(ours, outputPath); err != nil {
+		return nil, nil, nil, err
+	}
+	theirFiles, err = pathFiles(theirs, outputPath)
+	return forkFiles, ourFiles, theirFiles, err
+}
+
+// pathFiles lists the files below outputPath in commit, by their path relative to outputPath
+func pathFiles(commit *object.Commit, outputPath string) (map[string]*object.File, error) {
+	files := make(map[string]*object.File)
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	if outputPath = path.Clean(outputPath); outputPath != "." {
+		tree, err = tree.Tree(outputPath)
+		if err == object.ErrDirectoryNotFound {
+			return files, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	err = tree.Files().ForEach(func(f *object.File) error {
+		files[f.Name] = f
+		return nil
+	})
+	return files, err
+}
+
+func sameFile(a, b *object.File) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Hash == b.Hash && a.Mode == b.Mode
+}
+
+// mergeFiles merges the line changes of ours and theirs relative to fork (which is nil when both added the file)
+func mergeFiles(fork, ours, theirs *object.File) (merged string, ok bool, err error) {
+	contents := make([]string, 3)
+	for i, f := range []*object.File{fork, ours, theirs} {
+		if f == nil {
+			continue
+		}
+		if isBinary, err := f.IsBinary(); err != nil || isBinary {
+			return "", false, err
+		}
+		if contents[i], err = f.Contents(); err != nil {
+			return "", false, err
+		}
+	}
+	merged, ok = Merge3(contents[0], contents[1], contents[2])
+	return merged, ok, nil
+}
+
+// hunk replaces the base lines [start, end) with lines
+type hunk struct {
+	start, end int
+	lines      []string
+	theirs     bool
+}
+
+// Merge3 applies the line changes of both ours and theirs to base, reporting false if they overlap
+func Merge3(base, ours, theirs string) (string, bool) {
+	baseLines := splitLines(base)
+	hunks := append(diffHunks(base, ours, false), diffHunks(base, theirs, true)...)
+	sort.SliceStable(hunks, func(i, j int) bool { return hunks[i].start < hunks[j].start })
+
+	out := []string{}
+	pos := 0
+	for i := 0; i < len(hunks); {
+		// Collect the group of hunks touching each other
+		start, end := hunks[i].start, hunks[i].end
+		j := i + 1
+		for ; j < len(hunks) && hunks[j].start <= end; j++ {
+			if hunks[j].end > end {
+				end = hunks[j].end
+			}
+		}
+		group := hunks[i:j]
+		i = j
+
+		out = append(out, baseLines[pos:start]...)
+		pos = end
+		oursVersion := applyHunks(baseLines, start, end, group, false)
+		theirsVersion := applyHunks(baseLines, start, end, group, true)
+		if !hasSide(group, true) {
+			out = append(out, oursVersion...)
+		} else if !hasSide(group, false) || strings.Join(oursVersion, "") == strings.Join(theirsVersion, "") {
+			out = append(out, theirsVersion...)
+		} else {
+			return "", false
+		}
+	}
+	out = append(out, baseLines[pos:]...)
+	return strings.Join(out, ""), true
+}
+
+// applyHunks returns the base lines [start, end) with the hunks of one side applied
+func applyHunks(baseLines []string, start, end int, group []hunk, theirs bool) []string {
+	out := []string{}
+	pos := start
+	for _, h := range group {
+		if h.theirs != theirs {
+			continue
+		}
+		out = append(out, baseLines[pos:h.start]...)
+		out = append(out, h.lines...)
+		pos = h.end
+	}
+	return append(out, baseLines[pos:end]...)
+}
+
+func hasSide(group []hunk, theirs bool) bool {
+	for _, h := range group {
+		if h.theirs == theirs {
+			return true
+		}
+	}
+	return false
+}
+
+// diffHunks lists the changes from base to side as hunks of base lines
+func diffHunks(base, side string, theirs bool) (hunks []hunk) {
+	var current *hunk
+	pos := 0
+	for _, d := range linediff.Do(base, side) {
+		lines := splitLines(d.Text)
+		if d.Type == diffmatchpatch.DiffEqual {
+			if current != nil {
+				hunks = append(hunks, *current)
+				current = nil
+			}
+			pos += len(lines)
+			continue
+		}
+		if current == nil {
+			current = &hunk{start: pos, end: pos, theirs: theirs}
+		}
+		if d.Type == diffmatchpatch.DiffDelete {
+			pos += len(lines)
+			current.end = pos
+		} else {
+			current.lines = append(current.lines, lines...)
+		}
+	}
+	if current != nil {
+		hunks = append(hunks, *current)
+	}
+	return hunks
+}
+
+// splitLines splits text after each newline, keeping the newlines
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// writeObjectFile writes the contents of f to file in fs, keeping whether it is executable
+func writeObjectFile(fs billy.Filesystem, file string, f *object.File) error {
+	contents, err := f.Contents()
+	if err != nil {
+		return err
+	}
+	return writeFileMode(fs, file, contents, f.Mode)
+}
+
+// writeFileMode (re)creates file in fs with the permissions of a git file mode, including its parent directories
+func writeFileMode(fs billy.Filesystem, file string, contents string, mode filemode.FileMode) error {
+	perm := os.FileMode(0644)
+	if mode == filemode.Executable {
+		perm = 0755
+	}
+	if err := fs.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := fs.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = bytes.NewBufferString(contents).WriteTo(f)
+	return err
+}
@@ -0,0 +1,111 @@
+package gitlogic
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerge3(t *testing.T) {
+	base := "a: 1\nb: 2\nc: 3\nd: 4\n"
+	tests := []struct {
+		name, ours, theirs, merged string
+		ok                         bool
+	}{
+		{"only ours", "a: 0\nb: 2\nc: 3\nd: 4\n", base, "a: 0\nb: 2\nc: 3\nd: 4\n", true},
+		{"only theirs", base, "a: 1\nb: 2\nc: 3\nd: 5\n", "a: 1\nb: 2\nc: 3\nd: 5\n", true},
+		{"both distinct", "a: 0\nb: 2\nc: 3\nd: 4\n", "a: 1\nb: 2\nc: 3\nd: 5\ne: 6\n", "a: 0\nb: 2\nc: 3\nd: 5\ne: 6\n", true},
+		{"both same", "a: 1\nb: 9\nc: 3\nd: 4\n", "a: 1\nb: 9\nc: 3\nd: 4\n", "a: 1\nb: 9\nc: 3\nd: 4\n", true},
+		{"conflict", "a: 1\nb: 8\nc: 3\nd: 4\n", "a: 1\nb: 9\nc: 3\nd: 4\n", "", false},
+		{"adjacent", "a: 1\nb: 8\nc: 3\nd: 4\n", "a: 1\nb: 2\nc: 9\nd: 4\n", "", false},
+		{"insert both ends", "z: 0\n" + base, base + "e: 5\n", "z: 0\n" + base + "e: 5\n", true},
+	}
+	for _, tt := range tests {
+		merged, ok := Merge3(base, tt.ours, tt.theirs)
+		assert.Equal(t, tt.ok, ok, tt.name)
+		assert.Equal(t, tt.merged, merged, tt.name)
+	}
+}
+
+func TestMergePath(t *testing.T) {
+	fs := memfs.New()
+	repo, err := git.Init(memory.NewStorage(), fs)
+	assert.NoError(t, err)
+	w, err := repo.Worktree()
+	assert.NoError(t, err)
+	commit := func(files map[string]string, parent plumbing.Hash) *object.Commit {
+		if !parent.IsZero() {
+			assert.NoError(t, w.Checkout(&git.CheckoutOptions{Hash: parent, Force: true}))
+		}
+		for name, contents := range files {
+			if contents == "" {
+				fs.Remove(name)
+			} else if path.Ext(name) == ".sh" {
+				assert.NoError(t, util.WriteFile(fs, name, []byte(contents), 0755))
+			} else {
+				assert.NoError(t, util.WriteFile(fs, name, []byte(contents), 0644))
+			}
+		}
+		assert.NoError(t, addAllFiles(w))
+		hash, err := w.Commit("commit", &git.CommitOptions{Author: &object.Signature{Name: "F", Email: "f"}})
+		assert.NoError(t, err)
+		c, err := repo.CommitObject(hash)
+		assert.NoError(t, err)
+		return c
+	}
+
+	fork := commit(map[string]string{"app/a.yaml": "a: 1\nb: 2\nc: 3\n", "app/b.yaml": "b", "app/run.sh": "a\nb\nc\n", "other.yaml": "o"}, plumbing.ZeroHash)
+	ours := commit(map[string]string{"app/a.yaml": "a: 0\nb: 2\nc: 3\n", "app/c.yaml": "concurrent", "app/run.sh": "z\nb\nc\n", "other.yaml": "changed"}, fork.Hash)
+	theirs := commit(map[string]string{"app/a.yaml": "a: 1\nb: 2\nc: 4\n", "app/b.yaml": "", "app/run.sh": "a\nb\nz\n", "deploy.sh": "new", "readme.md": "r"}, fork.Hash)
+
+	merged, err := MergePath(ours, theirs, "app")
+	assert.NoError(t, err)
+	assertFile(t, merged, "a.yaml", "a: 0\nb: 2\nc: 4\n")
+	assertFile(t, merged, "c.yaml", "concurrent")
+	assertFile(t, merged, "run.sh", "z\nb\nz\n")
+	if stat, err := merged.Stat("run.sh"); assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0755), stat.Mode().Perm())
+	}
+	_, err = merged.Stat("b.yaml")
+	assert.Error(t, err)
+	_, err = merged.Stat("other.yaml")
+	assert.Error(t, err)
+
+	// Changes outside the path are merged into the worktree of ours, keeping files that ours changed as well
+	assert.NoError(t, w.Checkout(&git.CheckoutOptions{Hash: ours.Hash, Force: true}))
+	ours = commit(map[string]string{"readme.md": "ours"}, ours.Hash)
+	assert.NoError(t, MergeOutsidePath(fs, ours, theirs, "app"))
+	assertFile(t, fs, "app/a.yaml", "a: 0\nb: 2\nc: 3\n")
+	assertFile(t, fs, "other.yaml", "changed")
+	assertFile(t, fs, "readme.md", "ours")
+	assertFile(t, fs, "deploy.sh", "new")
+	if stat, err := fs.Stat("deploy.sh"); assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0755), stat.Mode().Perm())
+	}
+
+	// Conflicting changes are reported
+	conflicting := commit(map[string]string{"app/a.yaml": "a: 2\nb: 2\nc: 3\n", "app/c.yaml": "other"}, fork.Hash)
+	_, err = MergePath(ours, conflicting, "app")
+	if assert.IsType(t, &ConflictError{}, err) {
+		assert.Equal(t, []string{"a.yaml (both modified)", "c.yaml (both modified)"}, err.(*ConflictError).Conflicts)
+	}
+}
+
+func assertFile(t *testing.T, fs billy.Filesystem, name, contents string) {
+	f, err := fs.Open(name)
+	if assert.NoError(t, err, name) {
+		defer f.Close()
+		data, _ := ioutil.ReadAll(f)
+		assert.Equal(t, contents, string(data), name)
+	}
+}
@@ -0,0 +1,234 @@
+package gitlogic
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"time"
+
+	. "github.com/Q42Philips/gitops-sync/pkg/config"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/pkg/errors"
+)
+
+// NotesRef is where the provenance records of sync commits are stored
+const NotesRef = plumbing.ReferenceName("refs/notes/gitops-sync")
+
+// Provenance is the structured record of how a sync commit was produced
+type Provenance struct {
+	SourceRepo   string    `json:"sourceRepo,omitempty"`
+	SourceCommit string    `json:"sourceCommit,omitempty"`
+	SourceRef    string    `json:"sourceRef,omitempty"`
+	PipelineURL  string    `json:"pipelineUrl,omitempty"`
+	Builder      Builder   `json:"builder"`
+	CommitTime   time.Time `json:"commitTime"`
+	SyncedAt     time.Time `json:"syncedAt"`
+	// Files maps the path in the output repository to the sha256 digest of the artifact
+	Files map[string]string `json:"files"`
+}
+
+// Builder identifies who and what created the sync commit
+type Builder struct {
+	Tool    string `json:"tool"`
+	Version string `json:"version,omitempty"`
+	User    string `json:"user,omitempty"`
+}
+
+// NewProvenance describes a sync of inputFs into the output path of the configuration
+func NewProvenance(c Config, inputFs billy.Filesystem, user string) (p Provenance, err error) {
+	p = Provenance{
+		SourceRepo:   c.SourceRepo,
+		SourceCommit: c.SourceCommit,
+		SourceRef:    c.SourceRef,
+		PipelineURL:  c.PipelineURL,
+		Builder:      Builder{Tool: "gitops-sync", Version: c.Version, User: user},
+		CommitTime:   time.Time(c.CommitTime),
+		SyncedAt:     time.Now(),
+		Files:        make(map[string]string),
+	}
+	err = digestFiles(inputFs, path.Clean(c.OutputRepoPath), p.Files)
+	return p, err
+}
+
+func digestFiles(fs billy.Filesystem, prefix string, digests map[string]string) error {
+	files, err := fs.ReadDir(".")
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := path.Join(prefix, f.Name())
+		if f.IsDir() {
+			sub, err := fs.Chroot(f.Name())
+			if err != nil {
+				return err
+			}
+			if err = digestFiles(sub, name, digests); err != nil {
+				return err
+			}
+			continue
+		}
+		file, err := fs.Open(f.Name())
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		digests[name] = fmt.Sprintf("sha256:%x", h.Sum(nil))
+	}
+	return nil
+}
+
+// AddNote stores the provenance as a note on target and moves the notes ref to the new notes commit.
+// An existing note for target is replaced, as a re-sync that did not change the commit still describes the latest sync.
+func AddNote(repo *git.Repository, target plumbing.Hash, p Provenance, signature *object.Signature) (notesHash plumbing.Hash, err error) {
+	var parents []plumbing.Hash
+	var entries []object.TreeEntry
+	if ref, err := repo.Reference(NotesRef, true); err == nil {
+		parent, err := repo.CommitObject(ref.Hash())
+		if err != nil {
+			return notesHash, errors.Wrap(err, "notes commit")
+		}
+		tree, err := parent.Tree()
+		if err != nil {
+			return notesHash, errors.Wrap(err, "notes tree")
+		}
+		parents = []plumbing.Hash{parent.Hash}
+		if entries, err = withoutNote(repo, tree, target.String()); err != nil {
+			return notesHash, errors.Wrap(err, "replacing note")
+		}
+	} else if err != plumbing.ErrReferenceNotFound {
+		return notesHash, err
+	}
+
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return notesHash, err
+	}
+	blob, err := storeBlob(repo, append(data, '\n'))
+	if err != nil {
+		return notesHash, errors.Wrap(err, "storing note")
+	}
+	entries = append(entries, object.TreeEntry{Name: target.String(), Mode: filemode.Regular, Hash: blob})
+
+	treeHash, err := storeTree(repo, entries)
+	if err != nil {
+		return notesHash, errors.Wrap(err, "storing notes tree")
+	}
+
+	commit := &object.Commit{
+		Author:       *signature,
+		Committer:    *signature,
+		Message:      fmt.Sprintf("Notes added by 'gitops-sync' for %s\n", target),
+		TreeHash:     treeHash,
+		ParentHashes: parents,
+	}
+	commitObj := repo.Storer.NewEncodedObject()
+	if err = commit.Encode(commitObj); err != nil {
+		return notesHash, err
+	}
+	if notesHash, err = repo.Storer.SetEncodedObject(commitObj); err != nil {
+		return notesHash, errors.Wrap(err, "storing notes commit")
+	}
+	err = repo.Storer.SetReference(plumbing.NewHashReference(NotesRef, notesHash))
+	return notesHash, err
+}
+
+// ReadNote returns the provenance stored for target
+func ReadNote(repo *git.Repository, target plumbing.Hash) (p Provenance, err error) {
+	ref, err := repo.Reference(NotesRef, true)
+	if err != nil {
+		return p, err
+	}
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		return p, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return p, err
+	}
+	file, err := noteFile(tree, target)
+	if err != nil {
+		return p, err
+	}
+	reader, err := file.Reader()
+	if err != nil {
+		return p, err
+	}
+	defer reader.Close()
+	err = json.NewDecoder(reader).Decode(&p)
+	return p, err
+}
+
+// noteFile finds the note of target, supporting the fan-out directories git uses for large notes trees
+func noteFile(tree *object.Tree, target plumbing.Hash) (*object.File, error) {
+	name := target.String()
+	if f, err := tree.File(name); err == nil {
+		return f, nil
+	}
+	return tree.File(name[:2] + "/" + name[2:])
+}
+
+// withoutNote returns the entries of the notes tree without the note file name, which can be in a fan-out directory
+func withoutNote(repo *git.Repository, tree *object.Tree, name string) ([]object.TreeEntry, error) {
+	entries := []object.TreeEntry{}
+	for _, e := range tree.Entries {
+		if e.Name == name {
+			continue
+		}
+		if e.Mode == filemode.Dir && len(name) > 2 && e.Name == name[:2] {
+			sub, err := tree.Tree(e.Name)
+			if err != nil {
+				return nil, err
+			}
+			subEntries, err := withoutNote(repo, sub, name[2:])
+			if err != nil {
+				return nil, err
+			}
+			if len(subEntries) == 0 {
+				continue
+			}
+			if e.Hash, err = storeTree(repo, subEntries); err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func storeTree(repo *git.Repository, entries []object.TreeEntry) (plumbing.Hash, error) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	obj := repo.Storer.NewEncodedObject()
+	if err := (&object.Tree{Entries: entries}).Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return repo.Storer.SetEncodedObject(obj)
+}
+
+func storeBlob(repo *git.Repository, data []byte) (plumbing.Hash, error) {
+	obj := repo.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if err = w.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return repo.Storer.SetEncodedObject(obj)
+}
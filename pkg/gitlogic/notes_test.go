@@ -0,0 +1,55 @@
+package gitlogic
+
+import (
+	"testing"
+
+	"github.com/Q42Philips/gitops-sync/pkg/config"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotes(t *testing.T) {
+	// Prepare git repo with a commit
+	fs := memfs.New()
+	repo, err := git.Init(memory.NewStorage(), fs)
+	assert.NoError(t, err)
+	w, err := repo.Worktree()
+	assert.NoError(t, err)
+	writeFile(fs, "README.md", "readme")
+	assert.NoError(t, addAllFiles(w))
+	signature := &object.Signature{Name: "F", Email: "f"}
+	hash, err := w.Commit("init", &git.CommitOptions{Author: signature})
+	assert.NoError(t, err)
+
+	// Input fs
+	inputFs := memfs.New()
+	writeFile(inputFs, "template.yaml", "updated: true")
+	provenance, err := NewProvenance(config.Config{OutputRepoPath: "bases/app", SourceCommit: "abc123"}, inputFs, "bot")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"bases/app/template.yaml": "sha256:90c786386a1665c8878096c32b8b4fb6a1fde4d2798e42d4dd4d3f3a813489aa"}, provenance.Files)
+
+	// Test
+	notesHash, err := AddNote(repo, hash, provenance, signature)
+	assert.NoError(t, err)
+	read, err := ReadNote(repo, hash)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc123", read.SourceCommit)
+	assert.Equal(t, "bot", read.Builder.User)
+
+	// Existing notes are replaced
+	provenance.SourceCommit = "def456"
+	again, err := AddNote(repo, hash, provenance, signature)
+	assert.NoError(t, err)
+	assert.NotEqual(t, notesHash, again)
+	read, err = ReadNote(repo, hash)
+	assert.NoError(t, err)
+	assert.Equal(t, "def456", read.SourceCommit)
+	notes, err := repo.CommitObject(again)
+	assert.NoError(t, err)
+	tree, err := notes.Tree()
+	assert.NoError(t, err)
+	assert.Len(t, tree.Entries, 1)
+}
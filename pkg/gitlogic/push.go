@@ -0,0 +1,255 @@
+package gitlogic
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/pkg/errors"
+)
+
+// RefUpdate changes a remote ref from Old to New, like `git push --force-with-lease=<ref>:<old>`.
+// A zero Old requires the ref to not exist yet, a zero New deletes the ref.
+type RefUpdate struct {
+	Name plumbing.ReferenceName
+	Old  plumbing.Hash
+	New  plumbing.Hash
+}
+
+func (u RefUpdate) String() string {
+	return fmt.Sprintf("%s (%s -> %s)", u.Name, shortHash(u.Old), shortHash(u.New))
+}
+
+func shortHash(h plumbing.Hash) string {
+	if h.IsZero() {
+		return "none"
+	}
+	return h.String()[:7]
+}
+
+// MergeUpdates combines the updates of the same ref into one, from the first Old to the last New, keeping the order
+// in which the refs were first updated. Updates that end where they started are dropped.
+func MergeUpdates(updates []RefUpdate) []RefUpdate {
+	index := make(map[plumbing.ReferenceName]int)
+	merged := []RefUpdate{}
+	for _, u := range updates {
+		if i, seen := index[u.Name]; seen {
+			merged[i].New = u.New
+			continue
+		}
+		index[u.Name] = len(merged)
+		merged = append(merged, u)
+	}
+	result := []RefUpdate{}
+	for _, u := range merged {
+		if u.Old != u.New {
+			result = append(result, u)
+		}
+	}
+	return result
+}
+
+// Push sends the ref updates to the origin remote. When the server supports atomic pushes, all refs are updated in a
+// single push, or none are. Otherwise the updates are pushed one by one in order, rolling back the already pushed
+// updates when one is rejected.
+//
+// Unlike git.Repository.Push the leases are checked by the server while updating, so parallel pushes cannot slip in.
+func Push(ctx context.Context, repo *git.Repository, auth transport.AuthMethod, updates []RefUpdate, progress io.Writer) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	remote, err := repo.Remote(git.DefaultRemoteName)
+	if err != nil {
+		return err
+	}
+	p := pusher{repo: repo, url: remote.Config().URLs[0], auth: auth, progress: progress}
+	sess, ar, err := p.open(ctx)
+	if err != nil {
+		return err
+	}
+	if ar.Capabilities.Supports(capability.Atomic) || len(updates) == 1 {
+		return p.send(ctx, sess, ar, updates)
+	}
+	sess.Close()
+	log.Println("Server does not support atomic pushes, pushing refs one by one")
+	return p.pushOrdered(ctx, updates)
+}
+
+type pusher struct {
+	repo     *git.Repository
+	url      string
+	auth     transport.AuthMethod
+	progress io.Writer
+}
+
+func (p pusher) open(ctx context.Context) (transport.ReceivePackSession, *packp.AdvRefs, error) {
+	ep, err := transport.NewEndpoint(p.url)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := client.NewClient(ep)
+	if err != nil {
+		return nil, nil, err
+	}
+	sess, err := c.NewReceivePackSession(ep, p.auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	ar, err := sess.AdvertisedReferencesContext(ctx)
+	if err != nil {
+		sess.Close()
+		return nil, nil, err
+	}
+	return sess, ar, nil
+}
+
+// pushOrdered pushes the updates one at a time, rolling back the pushed ones in reverse order if one fails
+func (p pusher) pushOrdered(ctx context.Context, updates []RefUpdate) error {
+	for i, u := range updates {
+		sess, ar, err := p.open(ctx)
+		if err == nil {
+			err = p.send(ctx, sess, ar, []RefUpdate{u})
+		}
+		if err == nil {
+			continue
+		}
+		for j := i - 1; j >= 0; j-- {
+			rollback := RefUpdate{Name: updates[j].Name, Old: updates[j].New, New: updates[j].Old}
+			log.Printf("Rolling back %s", rollback)
+			sess, ar, rbErr := p.open(ctx)
+			if rbErr == nil {
+				rbErr = p.send(ctx, sess, ar, []RefUpdate{rollback})
+			}
+			if rbErr != nil {
+				log.Printf("Warning: rolling back %s failed: %s", updates[j].Name, rbErr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// send pushes the updates in a single (atomic, if supported) request over sess, closing it
+func (p pusher) send(ctx context.Context, sess transport.ReceivePackSession, ar *packp.AdvRefs, updates []RefUpdate) (err error) {
+	defer func() {
+		if closeErr := sess.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	req := packp.NewReferenceUpdateRequestFromCapabilities(ar.Capabilities)
+	if ar.Capabilities.Supports(capability.Atomic) {
+		_ = req.Capabilities.Set(capability.Atomic)
+	}
+	if p.progress != nil {
+		req.Progress = p.progress
+		if ar.Capabilities.Supports(capability.Sideband64k) {
+			_ = req.Capabilities.Set(capability.Sideband64k)
+		} else if ar.Capabilities.Supports(capability.Sideband) {
+			_ = req.Capabilities.Set(capability.Sideband)
+		}
+	}
+
+	objects := []plumbing.Hash{}
+	for _, u := range updates {
+		req.Commands = append(req.Commands, &packp.Command{Name: u.Name, Old: u.Old, New: u.New})
+		if u.New.IsZero() {
+			if !ar.Capabilities.Supports(capability.DeleteRefs) {
+				return git.ErrDeleteRefNotSupported
+			}
+			continue
+		}
+		objects = append(objects, u.New)
+	}
+
+	// Send the objects the remote does not have yet
+	done := make(chan error, 1)
+	if len(objects) > 0 {
+		haves, err := remoteHashes(ar)
+		if err != nil {
+			return err
+		}
+		shallow, err := p.repo.Storer.Shallow()
+		if err != nil {
+			return err
+		}
+		hashes, err := revlist.Objects(p.repo.Storer, objects, append(haves, shallow...))
+		if err != nil {
+			return errors.Wrap(err, "listing objects to push")
+		}
+		cfg, err := p.repo.Storer.Config()
+		if err != nil {
+			return err
+		}
+		rd, wr := io.Pipe()
+		req.Packfile = rd
+		go func() {
+			e := packfile.NewEncoder(wr, p.repo.Storer, !ar.Capabilities.Supports(capability.OFSDelta))
+			if _, err := e.Encode(hashes, cfg.Pack.Window); err != nil {
+				done <- wr.CloseWithError(err)
+				return
+			}
+			done <- wr.Close()
+		}()
+		defer rd.Close()
+	} else {
+		close(done)
+	}
+
+	report, err := sess.ReceivePack(ctx, req)
+	if report != nil {
+		if reportErr := reportError(report); reportErr != nil {
+			return reportErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return <-done
+}
+
+// reportError lists all rejected refs of the report, as the first rejected ref of an atomic push is not necessarily the cause
+func reportError(report *packp.ReportStatus) error {
+	if report.UnpackStatus != "ok" {
+		return fmt.Errorf("unpack error: %s", report.UnpackStatus)
+	}
+	rejected := []string{}
+	for _, s := range report.CommandStatuses {
+		if s.Status != "ok" {
+			rejected = append(rejected, fmt.Sprintf("%s: %s", s.ReferenceName, s.Status))
+		}
+	}
+	if len(rejected) > 0 {
+		return fmt.Errorf("rejected %s", strings.Join(rejected, ", "))
+	}
+	return nil
+}
+
+func remoteHashes(ar *packp.AdvRefs) ([]plumbing.Hash, error) {
+	refs, err := ar.AllReferences()
+	if err != nil {
+		return nil, err
+	}
+	iter, err := refs.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	hashes := []plumbing.Hash{}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			hashes = append(hashes, ref.Hash())
+		}
+		return nil
+	})
+	return hashes, err
+}
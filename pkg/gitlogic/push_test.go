@@ -0,0 +1,103 @@
+package gitlogic
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeUpdates(t *testing.T) {
+	a, b, c := plumbing.NewHash("aa"), plumbing.NewHash("bb"), plumbing.NewHash("cc")
+	merged := MergeUpdates([]RefUpdate{
+		{Name: "refs/heads/head", Old: plumbing.ZeroHash, New: a},
+		{Name: "refs/notes/x", Old: b, New: c},
+		{Name: "refs/heads/base", Old: b, New: c},
+		{Name: "refs/notes/x", Old: c, New: a},
+		{Name: "refs/heads/head", Old: a, New: plumbing.ZeroHash},
+	})
+	assert.Equal(t, []RefUpdate{
+		{Name: "refs/notes/x", Old: b, New: a},
+		{Name: "refs/heads/base", Old: b, New: c},
+	}, merged)
+}
+
+func TestPush(t *testing.T) {
+	repo, remote, first, second := preparePush(t)
+	head, base := plumbing.NewBranchReferenceName("head"), plumbing.NewBranchReferenceName("master")
+
+	// Atomic: a stale lease on base rejects the head update too
+	err := Push(context.Background(), repo, nil, []RefUpdate{
+		{Name: head, Old: plumbing.ZeroHash, New: second},
+		{Name: base, Old: second, New: second},
+	}, nil)
+	assert.Error(t, err)
+	_, err = remote.Reference(head, true)
+	assert.Equal(t, plumbing.ErrReferenceNotFound, err)
+
+	err = Push(context.Background(), repo, nil, []RefUpdate{
+		{Name: head, Old: plumbing.ZeroHash, New: second},
+		{Name: base, Old: first, New: second},
+	}, nil)
+	assert.NoError(t, err)
+	assertRemoteRef(t, remote, head, second)
+	assertRemoteRef(t, remote, base, second)
+}
+
+func TestPushOrderedRollback(t *testing.T) {
+	repo, remote, first, second := preparePush(t)
+	head, base := plumbing.NewBranchReferenceName("head"), plumbing.NewBranchReferenceName("master")
+	origin, err := repo.Remote(git.DefaultRemoteName)
+	assert.NoError(t, err)
+	p := pusher{repo: repo, url: origin.Config().URLs[0]}
+
+	err = p.pushOrdered(context.Background(), []RefUpdate{
+		{Name: base, Old: first, New: second},
+		{Name: head, Old: first, New: second},
+	})
+	assert.Error(t, err)
+	assertRemoteRef(t, remote, base, first)
+}
+
+// preparePush creates a bare remote with a commit on master, and a clone with a second commit
+func preparePush(t *testing.T) (repo *git.Repository, remote *git.Repository, first, second plumbing.Hash) {
+	dir, err := os.MkdirTemp(os.TempDir(), "remote")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	remote, err = git.PlainInit(dir, true)
+	assert.NoError(t, err)
+
+	fs := memfs.New()
+	repo, err = git.Init(memory.NewStorage(), fs)
+	assert.NoError(t, err)
+	_, err = repo.CreateRemote(&config.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{dir}})
+	assert.NoError(t, err)
+	w, err := repo.Worktree()
+	assert.NoError(t, err)
+	signature := &object.Signature{Name: "F", Email: "f"}
+	writeFile(fs, "README.md", "readme")
+	assert.NoError(t, addAllFiles(w))
+	first, err = w.Commit("first", &git.CommitOptions{Author: signature})
+	assert.NoError(t, err)
+	assert.NoError(t, Push(context.Background(), repo, nil, []RefUpdate{{Name: "refs/heads/master", New: first}}, nil))
+
+	writeFile(fs, "README.md", "updated")
+	assert.NoError(t, addAllFiles(w))
+	second, err = w.Commit("second", &git.CommitOptions{Author: signature})
+	assert.NoError(t, err)
+	return repo, remote, first, second
+}
+
+func assertRemoteRef(t *testing.T, remote *git.Repository, name plumbing.ReferenceName, expected plumbing.Hash) {
+	ref, err := remote.Reference(name, true)
+	if assert.NoError(t, err, name) {
+		assert.Equal(t, expected, ref.Hash(), name)
+	}
+}
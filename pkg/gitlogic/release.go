@@ -0,0 +1,121 @@
+package gitlogic
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"text/template"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/pkg/errors"
+)
+
+// TagData is available in -tag and -tag-message templates, for example "deploy/{{.Branch}}/{{.Time}}"
+type TagData struct {
+	// Time of the sync commit, formatted as 2006-01-02T15-04-05 (UTC)
+	Time              string
+	Commit            string
+	ShortCommit       string
+	SourceCommit      string
+	ShortSourceCommit string
+	SourceRef         string
+	// Branch that the tagged commit is pushed to
+	Branch string
+}
+
+// NewTagData describes the tagged commit on branch, synced from sourceCommit
+func NewTagData(commit *object.Commit, branch, sourceCommit, sourceRef string) TagData {
+	return TagData{
+		Time:              commit.Committer.When.UTC().Format("2006-01-02T15-04-05"),
+		Commit:            commit.Hash.String(),
+		ShortCommit:       commit.Hash.String()[:7],
+		SourceCommit:      sourceCommit,
+		ShortSourceCommit: shortSHA(sourceCommit),
+		SourceRef:         sourceRef,
+		Branch:            branch,
+	}
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
+
+// Expand renders tmpl with the tag data
+func (d TagData) Expand(tmpl string) (string, error) {
+	t, err := template.New("tag").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", errors.Wrapf(err, "parsing template %q", tmpl)
+	}
+	out := &bytes.Buffer{}
+	if err = t.Execute(out, d); err != nil {
+		return "", errors.Wrapf(err, "rendering template %q", tmpl)
+	}
+	return out.String(), nil
+}
+
+// TagName renders the tag name template, checking that the result is a valid tag name
+func (d TagData) TagName(tmpl string) (string, error) {
+	name, err := d.Expand(tmpl)
+	if err != nil {
+		return "", err
+	}
+	if name == "" || strings.ContainsAny(name, " ~^:?*[\\") || strings.Contains(name, "..") ||
+		strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") || strings.HasSuffix(name, ".lock") {
+		return "", errors.Errorf("invalid tag name %q (from template %q)", name, tmpl)
+	}
+	return name, nil
+}
+
+// CreateTag points the tag name at target, replacing an existing local tag. Without message a lightweight tag is
+// created, otherwise an annotated tag by tagger, signed by signer if set. The hash of the tag ref is returned.
+func CreateTag(gr *git.Repository, name string, target plumbing.Hash, message string, tagger *object.Signature, signer Signer) (plumbing.Hash, error) {
+	hash := target
+	if message != "" {
+		tag := &object.Tag{
+			Name:       name,
+			Tagger:     *tagger,
+			Message:    strings.TrimRight(message, "\n") + "\n",
+			TargetType: plumbing.CommitObject,
+			Target:     target,
+		}
+		if signer != nil {
+			payload := &plumbing.MemoryObject{}
+			if err := tag.Encode(payload); err != nil {
+				return hash, err
+			}
+			reader, err := payload.Reader()
+			if err != nil {
+				return hash, err
+			}
+			data, err := ioutil.ReadAll(reader)
+			if err != nil {
+				return hash, err
+			}
+			if tag.PGPSignature, err = signer.Sign(data); err != nil {
+				return hash, errors.Wrap(err, "signing tag")
+			}
+		}
+		obj := gr.Storer.NewEncodedObject()
+		if err := tag.Encode(obj); err != nil {
+			return hash, err
+		}
+		var err error
+		if hash, err = gr.Storer.SetEncodedObject(obj); err != nil {
+			return hash, err
+		}
+	}
+	return hash, gr.Storer.SetReference(plumbing.NewHashReference(plumbing.NewTagReferenceName(name), hash))
+}
+
+// TagTarget returns the commit a (lightweight or annotated) tag ref points to
+func TagTarget(gr *git.Repository, ref *plumbing.Reference) plumbing.Hash {
+	if tag, err := gr.TagObject(ref.Hash()); err == nil {
+		return tag.Target
+	}
+	return ref.Hash()
+}
@@ -0,0 +1,65 @@
+package gitlogic
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func TestTagName(t *testing.T) {
+	commit := &object.Commit{
+		Hash:      plumbing.NewHash("0123456789abcdef0123456789abcdef01234567"),
+		Committer: object.Signature{When: time.Date(2026, 10, 16, 14, 0, 0, 0, time.FixedZone("CEST", 2*3600))},
+	}
+	data := NewTagData(commit, "prod", "fedcba9876543210", "main")
+
+	name, err := data.TagName("deploy/{{.Branch}}/{{.Time}}")
+	assert.NoError(t, err)
+	assert.Equal(t, "deploy/prod/2026-10-16T12-00-00", name)
+	name, err = data.TagName("{{.SourceRef}}-{{.ShortSourceCommit}}-{{.ShortCommit}}")
+	assert.NoError(t, err)
+	assert.Equal(t, "main-fedcba9-0123456", name)
+
+	_, err = data.TagName("deploy {{.Branch}}")
+	assert.Error(t, err)
+	_, err = data.TagName("{{.Unknown}}")
+	assert.Error(t, err)
+}
+
+func TestCreateTagSigned(t *testing.T) {
+	entity, err := openpgp.NewEntity("F", "", "f@example.com", nil)
+	assert.NoError(t, err)
+	armoredPublic := new(bytes.Buffer)
+	w, _ := armor.Encode(armoredPublic, openpgp.PublicKeyType, nil)
+	assert.NoError(t, entity.Serialize(w))
+	w.Close()
+
+	repo, _ := signTestSetup(t)
+	head, err := repo.Head()
+	assert.NoError(t, err)
+	hash, err := CreateTag(repo, "deploy/prod", head.Hash(), "Deploy", &object.Signature{Name: "F", Email: "f"}, &OpenPGPSigner{Entity: entity})
+	assert.NoError(t, err)
+
+	ref, err := repo.Reference(plumbing.NewTagReferenceName("deploy/prod"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, ref.Hash())
+	assert.Equal(t, head.Hash(), TagTarget(repo, ref))
+	tag, err := repo.TagObject(hash)
+	assert.NoError(t, err)
+	assert.Equal(t, "Deploy\n", tag.Message)
+	_, err = tag.Verify(armoredPublic.String())
+	assert.NoError(t, err)
+
+	// Lightweight tags point to the commit itself
+	hash, err = CreateTag(repo, "latest", head.Hash(), "", nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, head.Hash(), hash)
+	_, err = repo.TagObject(hash)
+	assert.Equal(t, plumbing.ErrObjectNotFound, err)
+}
@@ -0,0 +1,203 @@
+package gitlogic
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Signing formats, named like git's gpg.format setting
+const (
+	SigningFormatOpenPGP = "openpgp"
+	SigningFormatSSH     = "ssh"
+)
+
+// Signer creates the armored signature of a commit or tag payload,
+// for signature formats that go-git does not support natively.
+type Signer interface {
+	Sign(payload []byte) (string, error)
+}
+
+// LoadSigningKey reads the signing key file. For OpenPGP the decrypted entity is returned,
+// to be used as git.CommitOptions.SignKey, for SSH a Signer is returned.
+func LoadSigningKey(format, keyFile, passphrase string) (entity *openpgp.Entity, signer Signer, err error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "reading signing key")
+	}
+	switch format {
+	case SigningFormatOpenPGP, "":
+		entity, err = ParseOpenPGPKey(data, passphrase)
+	case SigningFormatSSH:
+		signer, err = ParseSSHKey(data, passphrase)
+	default:
+		err = errors.Errorf("unknown signing format %q, use %q or %q", format, SigningFormatOpenPGP, SigningFormatSSH)
+	}
+	return entity, signer, err
+}
+
+// OpenPGPSigner creates armored detached OpenPGP signatures, for objects signed through the Signer interface such as tags
+type OpenPGPSigner struct {
+	Entity *openpgp.Entity
+}
+
+// Sign implements Signer
+func (s *OpenPGPSigner) Sign(payload []byte) (string, error) {
+	out := &bytes.Buffer{}
+	if err := openpgp.ArmoredDetachSign(out, s.Entity, bytes.NewReader(payload), nil); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// ParseOpenPGPKey returns the first private key of an armored key ring, decrypted with passphrase
+func ParseOpenPGPKey(armored []byte, passphrase string) (*openpgp.Entity, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(armored))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading armored OpenPGP key")
+	}
+	for _, entity := range entities {
+		if entity.PrivateKey == nil {
+			continue
+		}
+		if entity.PrivateKey.Encrypted {
+			if err = entity.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+				return nil, errors.Wrap(err, "decrypting OpenPGP key")
+			}
+		}
+		for _, sub := range entity.Subkeys {
+			if sub.PrivateKey != nil && sub.PrivateKey.Encrypted {
+				if err = sub.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+					return nil, errors.Wrap(err, "decrypting OpenPGP subkey")
+				}
+			}
+		}
+		return entity, nil
+	}
+	return nil, errors.New("no OpenPGP private key found")
+}
+
+// ParseSSHKey reads an (optionally encrypted) SSH private key
+func ParseSSHKey(pem []byte, passphrase string) (Signer, error) {
+	var key ssh.Signer
+	var err error
+	if passphrase != "" {
+		key, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(passphrase))
+	} else {
+		key, err = ssh.ParsePrivateKey(pem)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading SSH key")
+	}
+	return &SSHSigner{Key: key}, nil
+}
+
+// SSHSigner creates SSH signatures (the format of `ssh-keygen -Y sign -n git`)
+type SSHSigner struct {
+	Key ssh.Signer
+}
+
+const (
+	sshSigMagic     = "SSHSIG"
+	sshSigNamespace = "git"
+	sshSigHash      = "sha512"
+)
+
+// Sign implements Signer
+func (s *SSHSigner) Sign(payload []byte) (string, error) {
+	message := sshSignedData(payload)
+
+	var sig *ssh.Signature
+	var err error
+	if algSigner, ok := s.Key.(ssh.AlgorithmSigner); ok && s.Key.PublicKey().Type() == ssh.KeyAlgoRSA {
+		// SHA-1 RSA signatures are not accepted for SSH signatures
+		sig, err = algSigner.SignWithAlgorithm(rand.Reader, message, ssh.SigAlgoRSASHA2512)
+	} else {
+		sig, err = s.Key.Sign(rand.Reader, message)
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "ssh signing")
+	}
+
+	blob := struct {
+		Version   uint32
+		PublicKey string
+		Namespace string
+		Reserved  string
+		Hash      string
+		Signature string
+	}{1, string(s.Key.PublicKey().Marshal()), sshSigNamespace, "", sshSigHash, string(ssh.Marshal(sig))}
+	encoded := base64.StdEncoding.EncodeToString(append([]byte(sshSigMagic), ssh.Marshal(blob)...))
+
+	armored := strings.Builder{}
+	armored.WriteString("-----BEGIN SSH SIGNATURE-----\n")
+	for len(encoded) > 70 {
+		armored.WriteString(encoded[:70] + "\n")
+		encoded = encoded[70:]
+	}
+	armored.WriteString(encoded + "\n")
+	armored.WriteString("-----END SSH SIGNATURE-----\n")
+	return armored.String(), nil
+}
+
+// sshSignedData is the message that is actually signed for an SSH signature of payload
+func sshSignedData(payload []byte) []byte {
+	digest := sha512.Sum512(payload)
+	signedData := struct {
+		Namespace string
+		Reserved  string
+		Hash      string
+		Digest    string
+	}{sshSigNamespace, "", sshSigHash, string(digest[:])}
+	return append([]byte(sshSigMagic), ssh.Marshal(signedData)...)
+}
+
+// signHead replaces the commit at HEAD by a copy signed by signer, and moves HEAD (or the branch it points to) along
+func signHead(gr *git.Repository, hash plumbing.Hash, signer Signer) (plumbing.Hash, error) {
+	commit, err := gr.CommitObject(hash)
+	if err != nil {
+		return hash, err
+	}
+	payload := &plumbing.MemoryObject{}
+	if err = commit.EncodeWithoutSignature(payload); err != nil {
+		return hash, err
+	}
+	reader, err := payload.Reader()
+	if err != nil {
+		return hash, err
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return hash, err
+	}
+	if commit.PGPSignature, err = signer.Sign(data); err != nil {
+		return hash, err
+	}
+	obj := gr.Storer.NewEncodedObject()
+	if err = commit.Encode(obj); err != nil {
+		return hash, err
+	}
+	signed, err := gr.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return hash, err
+	}
+
+	head, err := gr.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return hash, err
+	}
+	name := plumbing.HEAD
+	if head.Type() == plumbing.SymbolicReference {
+		name = head.Target()
+	}
+	return signed, gr.Storer.SetReference(plumbing.NewHashReference(name, signed))
+}
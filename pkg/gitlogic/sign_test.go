@@ -0,0 +1,99 @@
+package gitlogic
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSyncSignedSSH(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	key, err := ssh.NewSignerFromKey(private)
+	assert.NoError(t, err)
+
+	repo, inputFs := signTestSetup(t)
+	commit := Sync(repo, "app", inputFs, &git.CommitOptions{Author: &object.Signature{Name: "F", Email: "f"}}, "sync", &SSHSigner{Key: key})
+
+	// HEAD is moved to the signed commit
+	head, err := repo.Head()
+	assert.NoError(t, err)
+	assert.Equal(t, commit.Hash, head.Hash())
+
+	// Verify signature
+	assert.True(t, strings.HasPrefix(commit.PGPSignature, "-----BEGIN SSH SIGNATURE-----\n"))
+	armored := strings.TrimPrefix(strings.TrimSuffix(commit.PGPSignature, "-----END SSH SIGNATURE-----\n"), "-----BEGIN SSH SIGNATURE-----\n")
+	raw, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(armored, "\n", ""))
+	assert.NoError(t, err)
+	assert.Equal(t, sshSigMagic, string(raw[:6]))
+	var blob struct {
+		Version   uint32
+		PublicKey string
+		Namespace string
+		Reserved  string
+		Hash      string
+		Signature string
+	}
+	assert.NoError(t, ssh.Unmarshal(raw[6:], &blob))
+	assert.Equal(t, "git", blob.Namespace)
+	var sig ssh.Signature
+	assert.NoError(t, ssh.Unmarshal([]byte(blob.Signature), &sig))
+
+	payload := &plumbing.MemoryObject{}
+	assert.NoError(t, commit.EncodeWithoutSignature(payload))
+	reader, _ := payload.Reader()
+	data := new(bytes.Buffer)
+	data.ReadFrom(reader)
+	assert.NoError(t, key.PublicKey().Verify(sshSignedData(data.Bytes()), &sig))
+}
+
+func TestSyncSignedOpenPGP(t *testing.T) {
+	entity, err := openpgp.NewEntity("F", "", "f@example.com", nil)
+	assert.NoError(t, err)
+	armoredPrivate := new(bytes.Buffer)
+	w, _ := armor.Encode(armoredPrivate, openpgp.PrivateKeyType, nil)
+	assert.NoError(t, entity.SerializePrivate(w, nil))
+	w.Close()
+	armoredPublic := new(bytes.Buffer)
+	w, _ = armor.Encode(armoredPublic, openpgp.PublicKeyType, nil)
+	assert.NoError(t, entity.Serialize(w))
+	w.Close()
+
+	signKey, err := ParseOpenPGPKey(armoredPrivate.Bytes(), "")
+	assert.NoError(t, err)
+
+	repo, inputFs := signTestSetup(t)
+	commit := Sync(repo, "app", inputFs, &git.CommitOptions{Author: &object.Signature{Name: "F", Email: "f"}, SignKey: signKey}, "sync", nil)
+	_, err = commit.Verify(armoredPublic.String())
+	assert.NoError(t, err)
+}
+
+func signTestSetup(t *testing.T) (*git.Repository, billy.Filesystem) {
+	fs := memfs.New()
+	repo, err := git.Init(memory.NewStorage(), fs)
+	assert.NoError(t, err)
+	w, err := repo.Worktree()
+	assert.NoError(t, err)
+	writeFile(fs, "README.md", "readme")
+	assert.NoError(t, addAllFiles(w))
+	_, err = w.Commit("init", &git.CommitOptions{Author: &object.Signature{Name: "F", Email: "f"}})
+	assert.NoError(t, err)
+
+	inputFs := memfs.New()
+	writeFile(inputFs, "template.yaml", "updated: true")
+	return repo, inputFs
+}
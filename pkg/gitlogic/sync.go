@@ -10,7 +10,9 @@ import (
 	"github.com/pkg/errors"
 )
 
-func Sync(gr *git.Repository, outputPath string, inputFs billy.Filesystem, commitOpt *git.CommitOptions, msg string) *object.Commit {
+// Sync replaces outputPath by the contents of inputFs and commits the changes.
+// OpenPGP signing uses commitOpt.SignKey, other signature formats use signer (optional).
+func Sync(gr *git.Repository, outputPath string, inputFs billy.Filesystem, commitOpt *git.CommitOptions, msg string, signer Signer) *object.Commit {
 	// Do sync
 	w, err := gr.Worktree()
 	orFatal(err, "getting worktree")
@@ -46,6 +48,10 @@ func Sync(gr *git.Repository, outputPath string, inputFs billy.Filesystem, commi
 	w.Status()
 	hash, err := w.Commit(msg, commitOpt)
 	orFatal(err, "committing")
+	if signer != nil {
+		hash, err = signHead(gr, hash, signer)
+		orFatal(err, "signing commit")
+	}
 	log.Println("Created commit", hash.String())
 	obj, err := gr.CommitObject(hash)
 	orFatal(err, "getting commit")
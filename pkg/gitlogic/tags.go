@@ -17,7 +17,7 @@ import (
 
 func WaitForTags(ctx context.Context, c Config, commit plumbing.Hash, repo *git.Repository) (err error) {
 	var gitAuth transport.AuthMethod
-	_, gitAuth, err = c.GetClientAuth()
+	gitAuth, err = c.GetGitAuth()
 	if err != nil {
 		gitAuth, err = ssh.DefaultAuthBuilder("")
 		if err != nil {
@@ -0,0 +1,104 @@
+package gitlogic
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	. "github.com/Q42Philips/gitops-sync/pkg/config"
+)
+
+// Trailer keys describing where a sync commit originates from
+const (
+	TrailerSourceRepo   = "Source-Repo"
+	TrailerSourceCommit = "Source-Commit"
+	TrailerSourceRef    = "Source-Ref"
+	TrailerPipelineURL  = "Pipeline-URL"
+	TrailerSyncedBy     = "Synced-By"
+)
+
+var trailerLine = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9-]*):\s*(.*)$`)
+
+// Trailer is a single "Key: value" line at the end of a commit message
+type Trailer struct {
+	Key   string
+	Value string
+}
+
+// Trailers are the ordered trailers of a commit message
+type Trailers []Trailer
+
+// Get returns the last value for key (case-insensitive), or "" if absent
+func (t Trailers) Get(key string) string {
+	for i := len(t) - 1; i >= 0; i-- {
+		if strings.EqualFold(t[i].Key, key) {
+			return t[i].Value
+		}
+	}
+	return ""
+}
+
+func (t Trailers) String() string {
+	lines := make([]string, 0, len(t))
+	for _, tr := range t {
+		lines = append(lines, fmt.Sprintf("%s: %s", tr.Key, tr.Value))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// SourceTrailers describes the provenance of the sync from the configured source
+func SourceTrailers(c Config) (t Trailers) {
+	add := func(key, value string) {
+		if value != "" {
+			t = append(t, Trailer{Key: key, Value: value})
+		}
+	}
+	add(TrailerSourceRepo, c.SourceRepo)
+	add(TrailerSourceCommit, c.SourceCommit)
+	add(TrailerSourceRef, c.SourceRef)
+	add(TrailerPipelineURL, c.PipelineURL)
+	add(TrailerSyncedBy, strings.TrimSpace(fmt.Sprintf("gitops-sync %s", c.Version)))
+	return t
+}
+
+// AppendTrailers adds trailers to the message, joining an existing trailer block if there is one
+func AppendTrailers(msg string, t Trailers) string {
+	if len(t) == 0 {
+		return msg
+	}
+	msg = strings.TrimRight(msg, "\n")
+	if msg == "" {
+		return t.String() + "\n"
+	}
+	if _, ok := trailerBlock(msg); ok && strings.Contains(msg, "\n\n") {
+		return msg + "\n" + t.String() + "\n"
+	}
+	return msg + "\n\n" + t.String() + "\n"
+}
+
+// ParseTrailers reads back the trailers from the last paragraph of a commit message
+func ParseTrailers(msg string) Trailers {
+	msg = strings.TrimRight(msg, "\n")
+	if !strings.Contains(msg, "\n\n") {
+		// The subject line is never a trailer
+		return nil
+	}
+	t, _ := trailerBlock(msg)
+	return t
+}
+
+// trailerBlock parses the last paragraph of msg, ok is false if any line is not a trailer
+func trailerBlock(msg string) (t Trailers, ok bool) {
+	paragraph := msg
+	if i := strings.LastIndex(msg, "\n\n"); i >= 0 {
+		paragraph = msg[i+2:]
+	}
+	for _, line := range strings.Split(paragraph, "\n") {
+		m := trailerLine.FindStringSubmatch(line)
+		if m == nil {
+			return nil, false
+		}
+		t = append(t, Trailer{Key: m[1], Value: m[2]})
+	}
+	return t, len(t) > 0
+}
@@ -0,0 +1,34 @@
+package gitlogic
+
+import (
+	"testing"
+
+	"github.com/Q42Philips/gitops-sync/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrailers(t *testing.T) {
+	c := config.Config{
+		SourceRepo:   "https://gitlab.com/org/app",
+		SourceCommit: "abc123",
+		SourceRef:    "main",
+		Version:      "v1.2.3",
+	}
+	msg := AppendTrailers("Sync app/main", SourceTrailers(c))
+	assert.Equal(t, "Sync app/main\n\nSource-Repo: https://gitlab.com/org/app\nSource-Commit: abc123\nSource-Ref: main\nSynced-By: gitops-sync v1.2.3\n", msg)
+
+	trailers := ParseTrailers(msg)
+	assert.Len(t, trailers, 4)
+	assert.Equal(t, "abc123", trailers.Get(TrailerSourceCommit))
+	assert.Equal(t, "", trailers.Get(TrailerPipelineURL))
+}
+
+func TestTrailersExistingBlock(t *testing.T) {
+	msg := AppendTrailers("Subject\n\nBody text\n\nSigned-off-by: Someone <s@example.com>\n", Trailers{{Key: TrailerSyncedBy, Value: "gitops-sync"}})
+	assert.Equal(t, "Subject\n\nBody text\n\nSigned-off-by: Someone <s@example.com>\nSynced-By: gitops-sync\n", msg)
+	assert.Len(t, ParseTrailers(msg), 2)
+
+	// Subject lines and regular paragraphs are no trailers
+	assert.Empty(t, ParseTrailers("Fix: something"))
+	assert.Empty(t, ParseTrailers("Subject\n\nSome text: with a colon\nand more"))
+}
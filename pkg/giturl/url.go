@@ -0,0 +1,69 @@
+package giturl
+
+import (
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RepoURL is a parsed repository URL
+type RepoURL struct {
+	// Protocol is https, http, ssh, git or file. scp-like URLs (git@host:path) are ssh, local paths file.
+	Protocol string
+	User     string
+	// Host including the port, if any; empty for file URLs
+	Host string
+	// Owner is the path up to the repository, which can be nested (like GitLab subgroups) or include a context path
+	Owner string
+	// Name of the repository, without .git suffix
+	Name string
+}
+
+// scpURL matches scp-like URLs: [user@]host:path, where the host is no single (Windows drive) letter
+var scpURL = regexp.MustCompile(`^(?:([^@/]+)@)?([^@/:]{2,}):(.+)$`)
+
+// ParseRepoURL parses the URL forms git supports: https://host/owner/repo.git, ssh://user@host:port/owner/repo.git,
+// user@host:owner/repo.git, file:///path/repo.git and local paths
+func ParseRepoURL(raw string) (RepoURL, error) {
+	var result RepoURL
+	var path string
+	if strings.Contains(raw, "://") {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return result, err
+		}
+		result.Protocol, result.Host, path = u.Scheme, u.Host, u.Path
+		if u.User != nil {
+			result.User = u.User.Username()
+		}
+	} else if m := scpURL.FindStringSubmatch(raw); m != nil {
+		result.Protocol, result.User, result.Host, path = "ssh", m[1], m[2], m[3]
+	} else {
+		result.Protocol, path = "file", filepath.ToSlash(raw)
+	}
+	if result.Protocol == "file" {
+		result.Host = ""
+	}
+
+	path = strings.TrimSuffix(strings.TrimSuffix(path, "/"), ".git")
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		result.Owner, result.Name = strings.Trim(path[:i], "/"), path[i+1:]
+	} else {
+		result.Name = path
+	}
+	if result.Name == "" {
+		return result, errors.Errorf("no repository in url %q", raw)
+	}
+	if result.Protocol != "file" && result.Host == "" {
+		return result, errors.Errorf("no host in url %q", raw)
+	}
+	return result, nil
+}
+
+// Hostname is the host without port
+func (u RepoURL) Hostname() string {
+	return (&url.URL{Host: u.Host}).Hostname()
+}